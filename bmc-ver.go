@@ -29,13 +29,14 @@ type IMGINFO struct {
 	Tag    string
 	Commit string
 	Chksum string
+	Go     string `json:",omitempty"`
 }
 
 var Images = [5]IMAGE{
 	{"ubo", &worktreePath, "platina-mk1-bmc/u-boot", "platina-mk1-bmc-ubo.bin"},
-	{"dtb", &worktreePath, "platina-mk1-bmc/linux", "platina-mk1-bmc-dtb.bin"},
+	{"dtb", nil, "", "platina-mk1-bmc-dtb.bin"},
 	{"env", nil, ".", "platina-mk1-bmc-env.bin"},
-	{"ker", &worktreePath, "platina-mk1-bmc/linux", "platina-mk1-bmc.vmlinuz"},
+	{"ker", nil, "", "platina-mk1-bmc.vmlinuz"},
 	{"itb", &platinaPath, "goes-bmc", "platina-mk1-bmc-itb.bin"},
 }
 var ImgInfo [5]IMGINFO
@@ -47,7 +48,17 @@ func makeVer(k string) {
 		if Images[i].Path != nil {
 			dir = filepath.Join(**Images[i].Path, dir)
 		}
+		if dir == "" { // built from the shared linux worktree
+			var err error
+			dir, err = kernelSource("platina-mk1-bmc")
+			if err != nil {
+				panic(err)
+			}
+		}
 		getImageInfo(i, Images[i].Name, dir, Images[i].File)
+		if Images[i].Name == "itb" {
+			ImgInfo[i].Go = manifest.goVersion(goesPlatinaMk1Bmc.name)
+		}
 	}
 	writeVerFile(Release)
 }
@@ -102,6 +113,11 @@ func getImageInfo(x int, nm string, di string, im string) {
 		}
 		uu = strings.Split(string(u), "\n")
 		ImgInfo[x].Tag = (uu[0])
+		suffix, err := checkSourceTree(".")
+		if err != nil {
+			panic(err)
+		}
+		ImgInfo[x].Tag += suffix
 		u, err = exec.Command("git", "log", "-1").Output()
 		if err != nil {
 			panic(err)
@@ -0,0 +1,105 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// buildConfig is the optional JSON configuration file named by -config.
+// Command line flags override anything set here.
+type buildConfig struct {
+	// GnuPrefix maps a GOARCH to its cross compiler prefix,
+	// e.g. "arm": "arm-linux-gnueabihf-".
+	GnuPrefix map[string]string
+
+	// GoVersion maps a target name or GOARCH to the Go version it
+	// must be built with, e.g. "goes-platina-mk1": "go1.14".
+	GoVersion map[string]string
+
+	// GoRoots lists GOROOTs, or directories of GOROOTs, searched for
+	// pinned Go versions.
+	GoRoots []string
+
+	// GoToolchain permits selecting a pinned Go version with
+	// GOTOOLCHAIN when it isn't found in GoRoots, except -offline.
+	GoToolchain bool
+
+	// SizeBudget maps a target name to the maximum size in bytes of
+	// its kernel or initramfs archive.
+	SizeBudget map[string]int64
+
+	// BinaryBudget maps a target name to the maximum size in bytes of
+	// its stripped goes binary.
+	BinaryBudget map[string]int64
+
+	// Repos maps a repository name, e.g. "linux", to its path, which
+	// may be absolute or relative to -platinapath, and may be a bare
+	// mirror. -repo and GOES_BUILD_REPO_<NAME> override it.
+	Repos map[string]string
+
+	// Refs maps a worktree repository, or MACHINE/REPO, to the ref
+	// to check out, as for -ref, e.g. "linux": "platina-5.4".
+	Refs map[string]string
+
+	// Patches maps a kernel or boot loader target name to the patch
+	// series directory applied to its worktree.
+	Patches map[string]string
+
+	// Fragments maps a kernel target name to config fragments merged
+	// onto its defconfig after its own.
+	Fragments map[string][]string
+
+	// DTBs maps an ARM kernel target name to its device trees, each a
+	// DTB name followed by any overlays, e.g. "platina-mk1-bmc+rev2".
+	// The first is the default tree.
+	DTBs map[string][]string
+
+	// VulnDB is the directory of an offline copy of the Go
+	// vulnerability database in OSV format, as for -vulndb.
+	VulnDB string
+}
+
+var cfg buildConfig
+
+// loadConfig reads the configuration file. A missing file is not an error
+// unless it was explicitly named with -config.
+func loadConfig(fn string, explicit bool) error {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return err
+	}
+	if err = json.Unmarshal(b, &cfg); err != nil {
+		return fmt.Errorf("%s: %s", fn, err)
+	}
+	return nil
+}
+
+// parseKeyValues parses a flag value of the form "key=value,key=value" into
+// m, creating it if needed.
+func parseKeyValues(m map[string]string, s string) (map[string]string, error) {
+	if m == nil {
+		m = map[string]string{}
+	}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		f := strings.SplitN(kv, "=", 2)
+		if len(f) != 2 || f[0] == "" {
+			return nil, fmt.Errorf("%q is not of the form key=value",
+				kv)
+		}
+		m[f[0]] = f[1]
+	}
+	return m, nil
+}
@@ -0,0 +1,280 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A target's needs are the external tools and files its maker uses:
+//
+//	tool		executable found in PATH
+//	cross:tool	tool prefixed with the target's cross compiler prefix
+//	file:path	host file
+//	src:path	file or directory relative to -platinapath
+//	repo:name	repository located by findGitdir
+//	go:version	go command for a pinned Go version
+//
+// Targets with a dirName also need that directory under -platinapath, and
+// the go of their pinned Go version. Kernels with device tree overlays
+// also need fdtoverlay.
+var (
+	goNeeds        = []string{"go", "git"}
+	installerNeeds = []string{"go", "git", "zip", "file:fe1.so"}
+	initramfsNeeds = []string{"go", "git", "xz", "cross:strip",
+		"file:/etc/ssl/certs/ca-certificates.crt"}
+	kernelNeeds = []string{"make", "bc", "bison", "flex", "perl",
+		"depmod", "cross:gcc", "repo:linux"}
+	armKernelNeeds = append([]string{"dtc"}, kernelNeeds...)
+	kernelDebNeeds = []string{"make", "dpkg-deb", "cross:gcc",
+		"repo:linux"}
+	corebootNeeds = []string{"make", "gcc", "g++", "bison", "flex", "m4",
+		"patch", "cross:gcc", "repo:coreboot"}
+	ubootNeeds = []string{"make", "bison", "flex", "cross:gcc",
+		"repo:u-boot"}
+	itbNeeds = []string{"mkimage", "dtc",
+		"src:" + platinaGoesMainGoesPlatinaMk1BmcDir + "/goes-bmc.its"}
+	zipNeeds           = []string{"git", "sha1sum"}
+	debianControlNeeds = []string{"file:debian/control.in", "repo:linux"}
+)
+
+var (
+	minToolVersions = map[string]string{
+		"go":   "1.13",
+		"git":  "2.5", // git worktree
+		"make": "3.81",
+	}
+	toolVersionArgs = map[string][]string{
+		"go":      {"version"},
+		"mkimage": {"-V"},
+	}
+	toolPackages = map[string]string{
+		"bc":         "bc",
+		"bison":      "bison",
+		"dpkg-deb":   "dpkg",
+		"dtc":        "device-tree-compiler",
+		"fdtoverlay": "device-tree-compiler",
+		"flex":       "flex",
+		"g++":        "g++",
+		"gcc":        "gcc",
+		"git":        "git",
+		"go":         "golang",
+		"m4":         "m4",
+		"make":       "make",
+		"mkimage":    "u-boot-tools",
+		"patch":      "patch",
+		"perl":       "perl",
+		"sha1sum":    "coreutils",
+		"xz":         "xz-utils",
+		"zip":        "zip",
+
+		"/etc/ssl/certs/ca-certificates.crt": "ca-certificates",
+	}
+)
+
+type doctorCheck struct {
+	need    string
+	ok      bool
+	detail  string
+	targets []string
+}
+
+func doctor(args []string) error {
+	tgs, err := selectTargets(args)
+	if err != nil {
+		return err
+	}
+	checks := []*doctorCheck{}
+	byNeed := map[string]*doctorCheck{}
+	visited := map[*target]bool{}
+	var visit func(tg *target)
+	visit = func(tg *target) {
+		if visited[tg] {
+			return
+		}
+		visited[tg] = true
+		for _, dep := range tg.dependencies {
+			visit(dep)
+		}
+		for _, need := range targetNeeds(tg) {
+			c, found := byNeed[need]
+			if !found {
+				c = checkNeed(need)
+				byNeed[need] = c
+				checks = append(checks, c)
+			}
+			c.targets = append(c.targets, tg.name)
+		}
+	}
+	for _, tg := range tgs {
+		visit(tg)
+	}
+	problems := 0
+	for _, c := range checks {
+		status := "ok"
+		if !c.ok {
+			status = "MISSING"
+			problems++
+		}
+		fmt.Printf("%-8s %-40s %s\n", status, c.need, c.detail)
+		if !c.ok {
+			fmt.Printf("%-8s %-40s needed by %s\n", "", "",
+				strings.Join(c.targets, ", "))
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	fmt.Println("# All prerequisites found")
+	return nil
+}
+
+// targetNeeds returns the needs of tg with cross tools resolved to the
+// prefixed tool name.
+func targetNeeds(tg *target) (needs []string) {
+	for _, need := range tg.needs {
+		if strings.HasPrefix(need, "cross:") {
+			tool := strings.TrimPrefix(need, "cross:")
+			prefix, err := tg.env.findCrossCompile()
+			if err != nil {
+				// suggest the first candidate to install
+				need = "cross:" + tg.env.goarch + ":" +
+					tg.env.gnuPrefixes[0] + tool
+			} else {
+				need = prefix + tool
+			}
+		}
+		needs = append(needs, need)
+	}
+	if tg.dirName != "" {
+		needs = append(needs, "src:"+tg.dirName)
+		if v := tg.env.pinnedGoVersion(tg); v != "" {
+			needs = append(needs, "go:"+v)
+		}
+	}
+	if tg.hasOverlays() {
+		needs = append(needs, "fdtoverlay")
+	}
+	return
+}
+
+func checkNeed(need string) *doctorCheck {
+	c := &doctorCheck{need: need}
+	kind := ""
+	arg := need
+	if i := strings.Index(need, ":"); i > 0 {
+		kind, arg = need[:i], need[i+1:]
+	}
+	switch kind {
+	case "":
+		c.ok, c.detail = checkTool(arg)
+	case "cross":
+		f := strings.SplitN(arg, ":", 2)
+		c.detail = fmt.Sprintf("no %s cross compiler in PATH; "+
+			"install one%s or use -gnuprefix %s=PREFIX",
+			f[0], installHint(f[1]), f[0])
+	case "go":
+		tc, err := findGoToolchain(arg)
+		if err != nil {
+			c.detail = err.Error() +
+				"; install it or use -goroots or -gotoolchain"
+		} else {
+			c.ok, c.detail = true, tc.path+": "+tc.version
+		}
+	case "file":
+		c.ok, c.detail = checkFile(arg)
+	case "src":
+		c.ok, c.detail = checkFile(filepath.Join(*platinaPath, arg))
+	case "repo":
+		gitdir, err := findGitdir(arg)
+		if err != nil && *offlineFlag {
+			c.detail = err.Error()
+		} else if err != nil {
+			c.detail = fmt.Sprintf("%s; clone it under %s "+
+				"or use -repo %s=PATH", err, *platinaPath, arg)
+		} else {
+			c.ok, c.detail = true, gitdir
+		}
+	default:
+		c.detail = "unknown requirement"
+	}
+	return c
+}
+
+func checkTool(tool string) (bool, string) {
+	path, err := exec.LookPath(tool)
+	if err != nil {
+		return false, "not found in PATH" + installHint(tool)
+	}
+	args, found := toolVersionArgs[tool]
+	if !found {
+		args = []string{"--version"}
+	}
+	ver := toolVersion(path, args...)
+	if want, found := minToolVersions[tool]; found &&
+		!versionAtLeast(ver, want) {
+		return false, fmt.Sprintf("%q is older than %s%s", ver, want,
+			installHint(tool))
+	}
+	if ver == "" {
+		ver = path
+	}
+	return true, ver
+}
+
+func checkFile(fn string) (bool, string) {
+	if _, err := os.Stat(fn); err != nil {
+		return false, err.Error() + installHint(fn)
+	}
+	return true, fn
+}
+
+func installHint(need string) string {
+	pkg, found := toolPackages[need]
+	if !found {
+		for _, tool := range []string{"gcc", "strip"} {
+			if strings.HasSuffix(need, "-"+tool) {
+				pkg = strings.Replace(strings.TrimSuffix(need,
+					"-"+tool), "_", "-", -1)
+				if tool == "gcc" {
+					pkg = "gcc-" + pkg
+				} else {
+					pkg = "binutils-" + pkg
+				}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return ""
+	}
+	return " (apt install " + pkg + ")"
+}
+
+var versionRegexp = regexp.MustCompile(`[0-9]+(\.[0-9]+)+`)
+
+// versionAtLeast reports whether the first dotted version number in have
+// is at least want.
+func versionAtLeast(have, want string) bool {
+	h := strings.Split(versionRegexp.FindString(have), ".")
+	w := strings.Split(want, ".")
+	for i := range w {
+		if i >= len(h) {
+			return false
+		}
+		hn, _ := strconv.Atoi(h[i])
+		wn, _ := strconv.Atoi(w[i])
+		if hn != wn {
+			return hn > wn
+		}
+	}
+	return true
+}
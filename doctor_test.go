@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestVersionAtLeast(t *testing.T) {
+	for _, tc := range []struct {
+		have, want string
+		ok         bool
+	}{
+		{"go version go1.14.4 linux/amd64", "1.13", true},
+		{"go version go1.12 linux/amd64", "1.13", false},
+		{"git version 2.20.1", "2.5", true},
+		{"git version 2.4.11", "2.5", false},
+		{"GNU Make 4.2.1", "3.81", true},
+		{"GNU Make 3.81", "3.81", true},
+		{"", "1.0", false},
+	} {
+		if ok := versionAtLeast(tc.have, tc.want); ok != tc.ok {
+			t.Errorf("versionAtLeast(%q, %q) = %v", tc.have,
+				tc.want, ok)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dtsDir holds device tree overlay sources, in dtsDir/MACHINE for those of
+// one machine, for overlays the kernel doesn't build.
+const dtsDir = "dts"
+
+// deviceTree is a device tree an ARM kernel target carries, written
+// BASE[+OVERLAY...]: a DTB the kernel builds and the overlays applied to
+// it, e.g. platina-mk1-bmc+rev2 for a board revision.
+type deviceTree struct {
+	name     string
+	base     string
+	overlays []string
+}
+
+func parseDeviceTree(s string) deviceTree {
+	f := strings.Split(s, "+")
+	return deviceTree{name: s, base: f[0], overlays: f[1:]}
+}
+
+// deviceTrees returns the device trees of the kernel target tg from the
+// configuration, by default just MACHINE. The first is the default tree.
+func (tg *target) deviceTrees() (trees []deviceTree) {
+	_, machine := tg.worktree()
+	names := cfg.DTBs[tg.name]
+	if len(names) == 0 {
+		names = []string{machine}
+	}
+	for _, name := range names {
+		trees = append(trees, parseDeviceTree(name))
+	}
+	return
+}
+
+// hasOverlays reports whether any device tree of tg has overlays, which
+// need the kernel to build its DTBs with symbols.
+func (tg *target) hasOverlays() bool {
+	for _, dt := range tg.deviceTrees() {
+		if len(dt.overlays) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// flatten reports whether the overlays of the i'th device tree are
+// applied at build time. Those of the default tree always are since it
+// is loaded on its own, as MACHINE-dtb.bin.
+func (dt deviceTree) flatten(i int) bool {
+	return len(dt.overlays) > 0 && (i == 0 || *fdtOverlayFlag)
+}
+
+// deviceTreeDir holds the device trees of machine after the default one.
+func deviceTreeDir(machine string) string {
+	return machine + "-dtbs"
+}
+
+// files returns the DTB and overlays the ITS loads for the i'th device
+// tree of machine.
+func (dt deviceTree) files(machine string, i int) []string {
+	if i == 0 {
+		return []string{machine + "-dtb.bin"}
+	}
+	dir := deviceTreeDir(machine)
+	if dt.flatten(i) {
+		return []string{filepath.Join(dir, dt.name+".dtb")}
+	}
+	files := []string{filepath.Join(dir, dt.base+".dtb")}
+	for _, ovl := range dt.overlays {
+		files = append(files, filepath.Join(dir, ovl+".dtbo"))
+	}
+	return files
+}
+
+// installDeviceTrees copies the DTBs and overlays of the kernel target tg,
+// built in out, beside the kernel, compiling overlays it doesn't build
+// from dts, applying overlays that are flattened with fdtoverlay, and
+// validates each with dtc.
+func installDeviceTrees(tg *target, out string) error {
+	_, machine := tg.worktree()
+	built := filepath.Join(out, "arch/arm/boot/dts")
+	dir := deviceTreeDir(machine)
+	trees := tg.deviceTrees()
+	cmdline := "rm -rf " + dir
+	if len(trees) > 1 || tg.hasOverlays() {
+		cmdline += " && mkdir -p " + dir
+	}
+	if err := shellCommandRun(cmdline); err != nil {
+		return err
+	}
+	for i, dt := range trees {
+		dst := dt.files(machine, i)
+		base := filepath.Join(built, dt.base+".dtb")
+		if !dt.flatten(i) {
+			if err := installDeviceTree(base, dst[0]); err != nil {
+				return err
+			}
+		}
+		overlays := []string{}
+		for j, ovl := range dt.overlays {
+			src, err := overlaySource(built, machine, ovl)
+			if err != nil {
+				return err
+			}
+			fn := filepath.Join(dir, ovl+".dtbo")
+			if strings.HasSuffix(src, ".dts") {
+				err = shellCommandRun("dtc -q -@ -I dts -O dtb" +
+					" -o " + fn + " " + src)
+			} else {
+				err = shellCommandRun("cp " + src + " " + fn)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %s", src, err)
+			}
+			if !dt.flatten(i) {
+				if err = installDeviceTree(fn, dst[j+1]); err != nil {
+					return err
+				}
+			}
+			overlays = append(overlays, fn)
+		}
+		if dt.flatten(i) {
+			if err := shellCommandRun("fdtoverlay -i " + base +
+				" -o " + dst[0] + " " +
+				strings.Join(overlays, " ")); err != nil {
+				return fmt.Errorf("%s: can't apply %s: %s", dt.name,
+					strings.Join(dt.overlays, ", "), err)
+			}
+			if err := checkDeviceTree(dst[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// installDeviceTree copies and validates the DTB or overlay src to dst,
+// unless they are the same file.
+func installDeviceTree(src, dst string) error {
+	if src != dst {
+		if err := shellCommandRun("cp " + src + " " + dst); err != nil {
+			return err
+		}
+	}
+	return checkDeviceTree(dst)
+}
+
+// checkDeviceTree validates the DTB or overlay fn with dtc.
+func checkDeviceTree(fn string) error {
+	if err := shellCommandRun("dtc -q -I dtb -O dtb -o /dev/null " +
+		fn); err != nil {
+		return fmt.Errorf("%s isn't a valid device tree: %s", fn, err)
+	}
+	return nil
+}
+
+// overlaySource returns the overlay ovl built by the kernel in built, or
+// its source in dts/MACHINE or dts.
+func overlaySource(built, machine, ovl string) (string, error) {
+	tried := []string{
+		filepath.Join(built, ovl+".dtbo"),
+		filepath.Join(dtsDir, machine, ovl+".dts"),
+		filepath.Join(dtsDir, ovl+".dts"),
+	}
+	if *nFlag {
+		return tried[0], nil
+	}
+	for _, fn := range tried {
+		if _, err := os.Stat(fn); err == nil {
+			return fn, nil
+		}
+	}
+	return "", fmt.Errorf("can't find device tree overlay %s; tried %s",
+		ovl, strings.Join(tried, ", "))
+}
+
+// itsTree is a device tree added to an ITS, with the files it loads.
+type itsTree struct {
+	name  string
+	files []string
+}
+
+// itsTrees returns the device trees of machine's kernel that the ITS
+// template doesn't already load, or nil if it loads them all.
+func itsTrees(machine string) ([]itsTree, error) {
+	tg, err := kernelTarget(machine)
+	if err != nil {
+		return nil, err
+	}
+	var trees []itsTree
+	for i, dt := range tg.deviceTrees() {
+		if i > 0 {
+			trees = append(trees, itsTree{dt.name,
+				dt.files(machine, i)})
+		}
+	}
+	return trees, nil
+}
+
+var (
+	itsDefaultRE     = regexp.MustCompile(`default\s*=\s*"([^"]+)"\s*;`)
+	itsFdtRE         = regexp.MustCompile(`(?m)^(\s*)fdt\s*=[^;]*;`)
+	itsDescriptionRE = regexp.MustCompile(`(?m)^(\s*)description\s*=[^;]*;`)
+	itsNodeNameRE    = regexp.MustCompile(`[^A-Za-z0-9,._+-]`)
+)
+
+// extendITS adds trees to the ITS template its: an fdt image for each
+// file, and a configuration for each tree copied from the default
+// configuration with its fdt replaced. U-Boot selects one with
+// bootm ADDR#conf-NAME.
+func extendITS(its string, trees []itsTree) (string, error) {
+	_, images, err := itsNode(its, "images")
+	if err != nil {
+		return "", err
+	}
+	start, configs, err := itsNode(its, "configurations")
+	if err != nil {
+		return "", err
+	}
+	m := itsDefaultRE.FindStringSubmatch(its[start:configs])
+	if m == nil {
+		return "", fmt.Errorf("ITS has no default configuration")
+	}
+	cstart, cend, err := itsNode(its[start:configs], m[1])
+	if err != nil {
+		return "", err
+	}
+	conf := its[start+cstart : start+cend]
+	if !itsFdtRE.MatchString(conf) {
+		return "", fmt.Errorf("ITS configuration %s has no fdt", m[1])
+	}
+
+	fdts, confs := &strings.Builder{}, &strings.Builder{}
+	added := map[string]bool{}
+	for _, tree := range trees {
+		nodes := []string{}
+		for _, fn := range tree.files {
+			node := "fdt-" + itsNodeNameRE.ReplaceAllString(
+				strings.TrimSuffix(filepath.Base(fn),
+					filepath.Ext(fn)), "_")
+			nodes = append(nodes, `"`+node+`"`)
+			if added[node] {
+				continue
+			}
+			added[node] = true
+			fmt.Fprintf(fdts, "\t\t%s {\n"+
+				"\t\t\tdescription = %q;\n"+
+				"\t\t\tdata = /incbin/(%q);\n"+
+				"\t\t\ttype = \"flat_dt\";\n"+
+				"\t\t\tarch = \"arm\";\n"+
+				"\t\t\tcompression = \"none\";\n"+
+				"\t\t};\n", node, filepath.Base(fn), fn)
+		}
+		c := itsFdtRE.ReplaceAllString(conf,
+			"${1}fdt = "+strings.Join(nodes, ", ")+";")
+		c = itsDescriptionRE.ReplaceAllString(c,
+			"${1}description = "+fmt.Sprintf("%q", tree.name)+";")
+		fmt.Fprintf(confs, "\t\tconf-%s {%s\t\t};\n",
+			itsNodeNameRE.ReplaceAllString(tree.name, "_"),
+			strings.TrimRight(c, " \t"))
+	}
+	// insert before the lines closing images and configurations
+	images = strings.LastIndexByte(its[:images], '\n') + 1
+	configs = strings.LastIndexByte(its[:configs], '\n') + 1
+	return its[:images] + fdts.String() +
+		its[images:configs] + confs.String() + its[configs:], nil
+}
+
+// itsNode returns the indexes in its of the body of the first node called
+// name, just after its opening brace and at its closing brace.
+func itsNode(its, name string) (start, end int, err error) {
+	re := regexp.MustCompile(`(?m)^\s*` + regexp.QuoteMeta(name) + `\s*\{`)
+	loc := re.FindStringIndex(its)
+	if loc == nil {
+		return 0, 0, fmt.Errorf("ITS has no %s node", name)
+	}
+	depth, quoted := 0, false
+	for i := loc[1] - 1; i < len(its); i++ {
+		switch c := its[i]; {
+		case c == '"' && its[i-1] != '\\':
+			quoted = !quoted
+		case quoted:
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return loc[1], i, nil
+			}
+		}
+	}
+	return 0, 0, fmt.Errorf("ITS: %s node isn't closed", name)
+}
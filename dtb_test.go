@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const testITS = `/dts-v1/;
+
+/ {
+	description = "goes-bmc";
+	images {
+		kernel@1 {
+			data = /incbin/("platina-mk1-bmc.vmlinuz");
+			type = "kernel";
+		};
+		fdt@1 {
+			description = "platina-mk1-bmc.dtb";
+			data = /incbin/("platina-mk1-bmc-dtb.bin");
+			type = "flat_dt";
+		};
+	};
+	configurations {
+		default = "conf@1";
+		conf@1 {
+			description = "Boot {goes}";
+			kernel = "kernel@1";
+			fdt = "fdt@1";
+		};
+	};
+};
+`
+
+func TestExtendITS(t *testing.T) {
+	its, err := extendITS(testITS, []itsTree{
+		{"platina-mk1-bmc+rev2", []string{
+			"platina-mk1-bmc-dtbs/platina-mk1-bmc.dtb",
+			"platina-mk1-bmc-dtbs/rev2.dtbo"}},
+		{"platina-mk1-bmc+rev3", []string{
+			"platina-mk1-bmc-dtbs/platina-mk1-bmc.dtb",
+			"platina-mk1-bmc-dtbs/rev3.dtbo"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\t\tfdt-rev2 {\n" +
+			"\t\t\tdescription = \"rev2.dtbo\";\n" +
+			"\t\t\tdata = /incbin/(\"platina-mk1-bmc-dtbs/rev2.dtbo\");\n",
+		"\t\t};\n\t};\n\tconfigurations {",
+		"\t\tconf-platina-mk1-bmc+rev3 {\n" +
+			"\t\t\tdescription = \"platina-mk1-bmc+rev3\";\n" +
+			"\t\t\tkernel = \"kernel@1\";\n" +
+			"\t\t\tfdt = \"fdt-platina-mk1-bmc\", \"fdt-rev3\";\n" +
+			"\t\t};\n\t};\n};\n",
+	} {
+		if !strings.Contains(its, want) {
+			t.Errorf("missing %q in\n%s", want, its)
+		}
+	}
+	if n := strings.Count(its, "fdt-platina-mk1-bmc {"); n != 1 {
+		t.Errorf("%d fdt-platina-mk1-bmc images, want 1", n)
+	}
+	if _, err = extendITS(strings.Replace(testITS, "default", "x", 1),
+		nil); err == nil {
+		t.Error("no error without a default configuration")
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// fileLock is an advisory flock(2) lock shared with other goes-build
+// processes. The kernel drops it when its holder exits, so the lock of a
+// goes-build that was killed is recovered by the next one to take it.
+type fileLock struct {
+	f    *os.File
+	name string
+}
+
+// lockFile takes the lock on the file fn, waiting if another process or
+// goroutine holds it. The holder's pid is kept in the file to say who is
+// being waited for.
+func lockFile(fn string) (*fileLock, error) {
+	if *nFlag {
+		return &fileLock{name: fn}, nil
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		holder := "another goes-build"
+		if pid := lockHolder(fn); pid > 0 {
+			holder = "pid " + strconv.Itoa(pid)
+		}
+		fmt.Printf("# waiting for lock %s held by %s\n", fn, holder)
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	} else if pid := lockHolder(fn); err == nil && pid > 0 &&
+		pid != os.Getpid() && !processAlive(pid) {
+		fmt.Printf("# recovered lock %s of exited pid %d\n", fn, pid)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %s", fn, err)
+	}
+	if err = f.Truncate(0); err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("lock %s: %s", fn, err)
+	}
+	return &fileLock{f: f, name: fn}, nil
+}
+
+// lockHolder returns the pid recorded in the lock file fn, or 0.
+func lockHolder(fn string) int {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	return pid
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// unlock releases the lock. The lock file is left in place; removing it
+// would let a waiter and a newcomer lock different files.
+func (l *fileLock) unlock() {
+	if l.f == nil {
+		return
+	}
+	l.f.Truncate(0)
+	l.f.Close()
+	l.f = nil
+}
+
+// lockDir takes the lock called name on dir. The lock file is kept in
+// the git directory of the tree containing dir, so it doesn't show up as
+// an untracked file, or in dir itself outside of git.
+func lockDir(dir, name string) (*fileLock, error) {
+	lockdir, err := shellCommandOutput("cd " + dir +
+		" && git rev-parse --absolute-git-dir 2>/dev/null")
+	if err != nil || lockdir == "" {
+		if lockdir, err = filepath.Abs(dir); err != nil {
+			return nil, err
+		}
+	}
+	return lockFile(filepath.Join(lockdir, "goes-build-"+name+".lock"))
+}
+
+// lockOutputs locks the current directory, where targets are written.
+func lockOutputs() (*fileLock, error) {
+	return lockDir(".", "outputs")
+}
@@ -0,0 +1,148 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// goflags are go build options declared by a target or by a -tags tag it
+// accepts. goDoForPkg applies them for every goenv.
+type goflags struct {
+	gcflags   string
+	asmflags  string
+	ldflags   string
+	ldvars    []string // main package variables to stamp with -X
+	trimpath  bool
+	buildmode string
+	race      bool
+	cover     bool
+}
+
+// Variables that may be listed in goflags.ldvars. main.Version is always
+// stamped.
+const (
+	ldvarCommit    = "Commit"
+	ldvarBuildDate = "BuildDate"
+	ldvarDirty     = "Dirty"
+	ldvarMachine   = "Machine"
+	ldvarGoVersion = "GoVersion"
+)
+
+var allLdvars = []string{ldvarCommit, ldvarBuildDate, ldvarDirty,
+	ldvarMachine, ldvarGoVersion}
+
+// merge returns the union of gf and other. Flag strings are concatenated,
+// a later buildmode replaces an earlier one.
+func (gf goflags) merge(other goflags) goflags {
+	join := func(a, b string) string {
+		if a == "" {
+			return b
+		}
+		if b == "" {
+			return a
+		}
+		return a + " " + b
+	}
+	gf.gcflags = join(gf.gcflags, other.gcflags)
+	gf.asmflags = join(gf.asmflags, other.asmflags)
+	gf.ldflags = join(gf.ldflags, other.ldflags)
+	for _, v := range other.ldvars {
+		found := false
+		for _, have := range gf.ldvars {
+			found = found || have == v
+		}
+		if !found {
+			gf.ldvars = append(append([]string{}, gf.ldvars...), v)
+		}
+	}
+	gf.trimpath = gf.trimpath || other.trimpath
+	gf.race = gf.race || other.race
+	gf.cover = gf.cover || other.cover
+	if other.buildmode != "" {
+		gf.buildmode = other.buildmode
+	}
+	return gf
+}
+
+// buildGoflags returns the go build options of tg, including those selected
+// by -tags and -variant.
+func (tg *target) buildGoflags() goflags {
+	gf := tg.goflags
+	for _, tag := range tg.activeUserTags() {
+		gf = gf.merge(tg.userTags[tag])
+	}
+	if v := tg.variant(); v != "" {
+		gf = gf.merge(variantGoflags[v])
+	}
+	return gf
+}
+
+// args returns the go command arguments for gf other than -ldflags.
+func (gf goflags) args() (args []string) {
+	if gf.gcflags != "" {
+		args = append(args, "-gcflags", gf.gcflags)
+	}
+	if gf.asmflags != "" {
+		args = append(args, "-asmflags", gf.asmflags)
+	}
+	if gf.trimpath {
+		args = append(args, "-trimpath")
+	}
+	if gf.buildmode != "" {
+		args = append(args, "-buildmode="+gf.buildmode)
+	}
+	if gf.race {
+		args = append(args, "-race")
+	}
+	if gf.cover {
+		args = append(args, "-cover")
+	}
+	return
+}
+
+// ldvarFlags returns the -X flags stamping gf.ldvars for tg built from the
+// git tree in dir.
+func (gf goflags) ldvarFlags(tg *target, dir string) (flags []string,
+	err error) {
+	for _, v := range gf.ldvars {
+		val := ""
+		switch v {
+		case ldvarCommit:
+			val, err = shellCommandOutput("cd " + dir +
+				" && git rev-parse HEAD")
+		case ldvarBuildDate:
+			val = time.Now().UTC().Format(time.RFC3339)
+		case ldvarDirty:
+			var dirty bool
+			dirty, err = gitDirty(dir)
+			if dirty {
+				val = "true"
+			} else {
+				val = "false"
+			}
+		case ldvarMachine:
+			val = tg.machine()
+		case ldvarGoVersion:
+			var tc *goToolchain
+			if tc, err = tg.env.goToolchain(tg); err == nil {
+				val = goVersionField(tc.version)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		flags = append(flags, "-X main."+v+"="+val)
+	}
+	return
+}
+
+// machine returns the machine name of a goes target, e.g. platina-mk1-bmc
+// for goes-platina-mk1-bmc.
+func (tg *target) machine() string {
+	return strings.TrimPrefix(strings.TrimSuffix(tg.name, ".test"),
+		"goes-")
+}
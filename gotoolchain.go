@@ -0,0 +1,169 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// goToolchain is a go command able to build a pinned Go version.
+type goToolchain struct {
+	path    string   // go command to run
+	env     []string // additional environment, e.g. GOTOOLCHAIN
+	version string   // output of "go version"
+}
+
+var (
+	goToolchains     = map[string]*goToolchain{}
+	goToolchainMutex sync.Mutex
+)
+
+// pinnedGoVersion returns the Go version tg must be built with, or the empty
+// string if any go in PATH will do. -goversion overrides everything, then
+// the configuration file by target name and GOARCH, then the target and
+// goenv declarations.
+func (goenv *goenv) pinnedGoVersion(tg *target) string {
+	for _, v := range []string{
+		*goVersionFlag,
+		cfg.GoVersion[tg.name],
+		cfg.GoVersion[goenv.goarch],
+		tg.goVersion,
+		goenv.goVersion,
+	} {
+		if v != "" {
+			if !strings.HasPrefix(v, "go") {
+				v = "go" + v
+			}
+			return v
+		}
+	}
+	return ""
+}
+
+// goToolchain returns the go command to build tg with, after checking
+// that it reports the pinned version.
+func (goenv *goenv) goToolchain(tg *target) (*goToolchain, error) {
+	version := goenv.pinnedGoVersion(tg)
+	goToolchainMutex.Lock()
+	defer goToolchainMutex.Unlock()
+	if tc, found := goToolchains[version]; found {
+		return tc, nil
+	}
+	tc, err := findGoToolchain(version)
+	if err != nil {
+		return nil, err
+	}
+	goToolchains[version] = tc
+	host.log("{go}", tc.path, "is", tc.version)
+	return tc, nil
+}
+
+func findGoToolchain(version string) (*goToolchain, error) {
+	if version == "" {
+		tc := &goToolchain{path: "go"}
+		tc.version = goCommandVersion(tc)
+		if tc.version == "" {
+			return nil, fmt.Errorf("can't run go version")
+		}
+		return tc, nil
+	}
+	local := []string{"GOTOOLCHAIN=local"}
+	tried := []string{}
+	for _, goroot := range goRoots(version) {
+		gocmd := filepath.Join(goroot, "bin", "go")
+		if _, err := os.Stat(gocmd); err != nil {
+			continue
+		}
+		tc := &goToolchain{path: gocmd, env: local}
+		tc.version = goCommandVersion(tc)
+		if goVersionMatches(tc.version, version) {
+			return tc, nil
+		}
+		tried = append(tried, gocmd+" ("+tc.version+")")
+	}
+	if gocmd, err := exec.LookPath("go"); err == nil {
+		tc := &goToolchain{path: gocmd, env: local}
+		tc.version = goCommandVersion(tc)
+		if goVersionMatches(tc.version, version) {
+			return tc, nil
+		}
+		tried = append(tried, gocmd+" ("+tc.version+")")
+		if (*goToolchainFlag || cfg.GoToolchain) && !*offlineFlag {
+			tc.env = []string{"GOTOOLCHAIN=" + version}
+			tc.version = goCommandVersion(tc)
+			if goVersionMatches(tc.version, version) {
+				return tc, nil
+			}
+			tried = append(tried, "GOTOOLCHAIN="+version+" "+gocmd+
+				" ("+tc.version+")")
+		}
+	}
+	if len(tried) == 0 {
+		return nil, fmt.Errorf("no go command found for %s", version)
+	}
+	return nil, fmt.Errorf("no go command found for %s; tried %s",
+		version, strings.Join(tried, ", "))
+}
+
+// goRoots returns the GOROOTs to search for version: each -goroots or
+// configured directory, any GOROOT directly beneath one, and the Debian
+// golang-X.Y package location.
+func goRoots(version string) (roots []string) {
+	dirs := cfg.GoRoots
+	if *goRootsFlag != "" {
+		dirs = filepath.SplitList(*goRootsFlag)
+	}
+	for _, dir := range dirs {
+		roots = append(roots, dir)
+		if matches, err := filepath.Glob(filepath.Join(dir, "*",
+			"bin", "go")); err == nil {
+			for _, m := range matches {
+				roots = append(roots, filepath.Dir(filepath.Dir(m)))
+			}
+		}
+	}
+	release := strings.TrimPrefix(version, "go")
+	if f := strings.Split(release, "."); len(f) > 2 {
+		release = f[0] + "." + f[1]
+	}
+	return append(roots, "/usr/lib/go-"+release)
+}
+
+// goCommandVersion returns the "go version" output of tc, or the empty
+// string if it can't be run.
+func goCommandVersion(tc *goToolchain) string {
+	cmd := exec.Command(tc.path, "version")
+	cmd.Env = append(os.Environ(), tc.env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// goVersionField returns the version in the "go version" output out, e.g.
+// go1.14.15.
+func goVersionField(out string) string {
+	if f := strings.Fields(out); len(f) > 2 {
+		return f[2]
+	}
+	return ""
+}
+
+// goVersionMatches reports whether the "go version" output out is of the
+// wanted version. A wanted release such as go1.14 matches any of its
+// patch releases.
+func goVersionMatches(out, want string) bool {
+	v := goVersionField(out)
+	if v == "" {
+		return false
+	}
+	return v == want || strings.HasPrefix(v, want+".")
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestGoVersionMatches(t *testing.T) {
+	for _, tc := range []struct {
+		out, want string
+		ok        bool
+	}{
+		{"go version go1.14.4 linux/amd64", "go1.14", true},
+		{"go version go1.14 linux/amd64", "go1.14", true},
+		{"go version go1.14.4 linux/amd64", "go1.14.4", true},
+		{"go version go1.14.4 linux/amd64", "go1.14.3", false},
+		{"go version go1.1 linux/amd64", "go1.14", false},
+		{"go version go1.15.2 linux/amd64", "go1.1", false},
+		{"", "go1.14", false},
+	} {
+		if ok := goVersionMatches(tc.out, tc.want); ok != tc.ok {
+			t.Errorf("goVersionMatches(%q, %q) = %v", tc.out,
+				tc.want, ok)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// testEvent is a line of go test2json output.
+type testEvent struct {
+	Time    time.Time
+	Action  string
+	Package string
+	Test    string
+	Elapsed float64
+	Output  string
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name          `xml:"testsuites"`
+	Suites  []*junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string           `xml:"name,attr"`
+	Tests      int              `xml:"tests,attr"`
+	Failures   int              `xml:"failures,attr"`
+	Skipped    int              `xml:"skipped,attr"`
+	Time       string           `xml:"time,attr"`
+	Timestamp  string           `xml:"timestamp,attr,omitempty"`
+	Properties []junitProperty  `xml:"properties>property,omitempty"`
+	Cases      []*junitTestCase `xml:"testcase"`
+	SystemOut  string           `xml:"system-out,omitempty"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// binaryTestName is the test case recording the outcome of a test binary
+// itself, e.g. a panic, timeout or a binary that could not be run.
+const binaryTestName = "(binary)"
+
+// junitFromTest2JSON converts test2json output of the test binary for
+// suite into a JUnit test suite. If exitErr is not nil and no test failed,
+// the failure is recorded against the binary.
+func junitFromTest2JSON(suite string, r io.Reader, exitErr error) (*junitTestSuite, error) {
+	ts := &junitTestSuite{Name: suite}
+	cases := map[string]*junitTestCase{}
+	output := map[string]*strings.Builder{}
+	var elapsed float64
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var ev testEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return nil, fmt.Errorf("%s: %s", suite, err)
+		}
+		if ts.Timestamp == "" && !ev.Time.IsZero() {
+			ts.Timestamp = ev.Time.UTC().Format("2006-01-02T15:04:05")
+		}
+		if _, found := output[ev.Test]; !found {
+			output[ev.Test] = &strings.Builder{}
+		}
+		switch ev.Action {
+		case "output":
+			output[ev.Test].WriteString(ev.Output)
+		case "pass", "fail", "skip":
+			if ev.Test == "" {
+				elapsed = ev.Elapsed
+				if ev.Action == "fail" && exitErr == nil {
+					exitErr = fmt.Errorf("test binary failed")
+				}
+				continue
+			}
+			tc := &junitTestCase{
+				Classname: suite,
+				Name:      ev.Test,
+				Time:      fmt.Sprintf("%.3f", ev.Elapsed),
+			}
+			out := output[ev.Test].String()
+			switch ev.Action {
+			case "fail":
+				tc.Failure = &junitMessage{Message: "Failed",
+					Text: out}
+				ts.Failures++
+			case "skip":
+				tc.Skipped = &junitMessage{Message: "Skipped",
+					Text: out}
+				ts.Skipped++
+			default:
+				tc.SystemOut = out
+			}
+			cases[ev.Test] = tc
+			ts.Cases = append(ts.Cases, tc)
+			ts.Tests++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", suite, err)
+	}
+	if b, found := output[""]; found {
+		ts.SystemOut = b.String()
+	}
+	// Tests that started but never finished were cut short by a panic
+	// or timeout.
+	incomplete := []string{}
+	for test := range output {
+		if _, found := cases[test]; test != "" && !found {
+			incomplete = append(incomplete, test)
+		}
+	}
+	sort.Strings(incomplete)
+	for _, test := range incomplete {
+		ts.Cases = append(ts.Cases, &junitTestCase{
+			Classname: suite,
+			Name:      test,
+			Time:      "0.000",
+			Failure: &junitMessage{Message: "Incomplete",
+				Text: output[test].String()},
+		})
+		ts.Tests++
+		ts.Failures++
+	}
+	if exitErr != nil && ts.Failures == 0 {
+		ts.Cases = append(ts.Cases, &junitTestCase{
+			Classname: suite,
+			Name:      binaryTestName,
+			Time:      fmt.Sprintf("%.3f", elapsed),
+			Failure: &junitMessage{Message: exitErr.Error(),
+				Text: ts.SystemOut},
+		})
+		ts.Tests++
+		ts.Failures++
+	}
+	ts.Time = fmt.Sprintf("%.3f", elapsed)
+	return ts, nil
+}
+
+// junitSkipped returns a test suite recording that the test binary for
+// suite was not run.
+func junitSkipped(suite, why string) *junitTestSuite {
+	return &junitTestSuite{
+		Name:    suite,
+		Tests:   1,
+		Skipped: 1,
+		Time:    "0.000",
+		Cases: []*junitTestCase{{
+			Classname: suite,
+			Name:      binaryTestName,
+			Time:      "0.000",
+			Skipped:   &junitMessage{Message: why},
+		}},
+	}
+}
+
+func (ts *junitTestSuite) write(w io.Writer) error {
+	b, err := xml.MarshalIndent(&junitTestSuites{
+		Suites: []*junitTestSuite{ts},
+	}, "", "\t")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
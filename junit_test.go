@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const test2jsonOutput = `{"Time":"2020-06-01T10:00:00Z","Action":"run","Package":"goes-ip.test","Test":"TestA"}
+{"Time":"2020-06-01T10:00:00Z","Action":"output","Package":"goes-ip.test","Test":"TestA","Output":"=== RUN   TestA\n"}
+{"Time":"2020-06-01T10:00:01Z","Action":"pass","Package":"goes-ip.test","Test":"TestA","Elapsed":1.5}
+{"Time":"2020-06-01T10:00:01Z","Action":"run","Package":"goes-ip.test","Test":"TestB"}
+{"Time":"2020-06-01T10:00:01Z","Action":"output","Package":"goes-ip.test","Test":"TestB","Output":"    b_test.go:10: wrong\n"}
+{"Time":"2020-06-01T10:00:02Z","Action":"fail","Package":"goes-ip.test","Test":"TestB","Elapsed":0.25}
+{"Time":"2020-06-01T10:00:02Z","Action":"run","Package":"goes-ip.test","Test":"TestC"}
+{"Time":"2020-06-01T10:00:02Z","Action":"skip","Package":"goes-ip.test","Test":"TestC","Elapsed":0}
+{"Time":"2020-06-01T10:00:02Z","Action":"output","Package":"goes-ip.test","Output":"FAIL\n"}
+{"Time":"2020-06-01T10:00:02Z","Action":"fail","Package":"goes-ip.test","Elapsed":2}
+`
+
+func TestJunitFromTest2JSON(t *testing.T) {
+	ts, err := junitFromTest2JSON("goes-ip.test",
+		strings.NewReader(test2jsonOutput), errors.New("exit status 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Tests != 3 || ts.Failures != 1 || ts.Skipped != 1 {
+		t.Errorf("got %d tests, %d failures, %d skipped",
+			ts.Tests, ts.Failures, ts.Skipped)
+	}
+	if ts.Time != "2.000" {
+		t.Errorf("suite time %s", ts.Time)
+	}
+	if f := ts.Cases[1].Failure; f == nil ||
+		!strings.Contains(f.Text, "wrong") {
+		t.Errorf("TestB failure %+v", f)
+	}
+}
+
+func TestJunitFromTest2JSONPanic(t *testing.T) {
+	in := `{"Action":"run","Test":"TestA"}
+{"Action":"output","Test":"TestA","Output":"panic: oops\n"}
+`
+	ts, err := junitFromTest2JSON("x.test", strings.NewReader(in),
+		errors.New("exit status 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Tests != 1 || ts.Failures != 1 ||
+		ts.Cases[0].Failure.Message != "Incomplete" {
+		t.Errorf("got %+v", ts.Cases)
+	}
+}
@@ -0,0 +1,334 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// kconfigDir holds kernel config fragments, in kconfigDir/MACHINE for
+// those of one machine. Fragments not found there are looked for in the
+// linux tree.
+const kconfigDir = "kconfig"
+
+// kernelTagFragments are the config fragments a -tags tag merges into the
+// kernels accepting it.
+var kernelTagFragments = map[string][]string{
+	tagDebug: {"debug.config"},
+}
+
+// kconfig is a kernel .config, defconfig or config fragment. A symbol
+// that is "not set" has the value "n".
+type kconfig struct {
+	names  []string
+	values map[string]string
+	from   map[string]string // file setting each symbol
+}
+
+func newKconfig() *kconfig {
+	return &kconfig{
+		values: map[string]string{},
+		from:   map[string]string{},
+	}
+}
+
+// parseKconfig parses the CONFIG_ lines of the kernel config file fn.
+func parseKconfig(fn string, b []byte) *kconfig {
+	kc := newKconfig()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "# CONFIG_") &&
+			strings.HasSuffix(line, " is not set") {
+			kc.set(strings.TrimSuffix(strings.TrimPrefix(line, "# "),
+				" is not set"), "n", fn)
+		} else if i := strings.IndexByte(line, '='); i > 0 &&
+			strings.HasPrefix(line, "CONFIG_") {
+			kc.set(line[:i], line[i+1:], fn)
+		}
+	}
+	return kc
+}
+
+func readKconfig(fn string) (*kconfig, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseKconfig(filepath.Base(fn), b), nil
+}
+
+func (kc *kconfig) set(name, value, from string) {
+	if _, found := kc.values[name]; !found {
+		kc.names = append(kc.names, name)
+	}
+	kc.values[name] = value
+	kc.from[name] = from
+}
+
+// line formats the setting of name as in a .config.
+func (kc *kconfig) line(name string) string {
+	if value := kc.values[name]; value != "n" {
+		return name + "=" + value
+	}
+	return "# " + name + " is not set"
+}
+
+func (kc *kconfig) bytes() []byte {
+	buf := &bytes.Buffer{}
+	for _, name := range kc.names {
+		fmt.Fprintln(buf, kc.line(name))
+	}
+	return buf.Bytes()
+}
+
+// merge sets the symbols of the fragment frag, as merge_config.sh does,
+// returning a warning for each symbol it changes.
+func (kc *kconfig) merge(frag *kconfig) (warnings []string) {
+	for _, name := range frag.names {
+		if prev, found := kc.values[name]; found &&
+			prev != frag.values[name] {
+			warnings = append(warnings, fmt.Sprintf("%s: %s "+
+				"overrides %s from %s", frag.from[name],
+				frag.line(name), kc.line(name), kc.from[name]))
+		}
+		kc.set(name, frag.values[name], frag.from[name])
+	}
+	return
+}
+
+// unmet returns the settings of requested that the .config kc doesn't
+// have, e.g. because of unmet dependencies.
+func (kc *kconfig) unmet(requested *kconfig) (unmet []string) {
+	for _, name := range requested.names {
+		want := requested.values[name]
+		got, found := kc.values[name]
+		if !found {
+			got = "n"
+		}
+		if got != want {
+			unmet = append(unmet, fmt.Sprintf("%s (from %s)",
+				requested.line(name), requested.from[name]))
+		}
+	}
+	return
+}
+
+// kernelFragments returns the config fragments of the kernel target tg:
+// those of the configuration, then those of its -tags.
+func (tg *target) kernelFragments() []string {
+	fragments := append([]string{}, cfg.Fragments[tg.name]...)
+	for _, tag := range tg.activeUserTags() {
+		fragments = append(fragments, kernelTagFragments[tag]...)
+	}
+	return fragments
+}
+
+// findFragment returns the path of the config fragment name of machine:
+// kconfig/MACHINE/NAME, kconfig/NAME, or NAME in the arch configs or
+// kernel/configs directory of the linux tree src.
+func (goenv *goenv) findFragment(src, machine, name string) (string, error) {
+	tried := []string{
+		filepath.Join(kconfigDir, machine, name),
+		filepath.Join(kconfigDir, name),
+		filepath.Join(src, goenv.kernelConfigPath, name),
+		filepath.Join(src, "kernel/configs", name),
+	}
+	for _, fn := range tried {
+		if _, err := os.Stat(fn); err == nil {
+			return filepath.Abs(fn)
+		}
+	}
+	return "", fmt.Errorf("can't find kernel config fragment %s; "+
+		"tried %s", name, strings.Join(tried, ", "))
+}
+
+// mergedDefconfig is the file in a kernel build directory that
+// mergeKernelConfig writes.
+const mergedDefconfig = "goes-build_defconfig"
+
+// mergeKernelConfig writes the defconfig of tg with its fragments merged
+// on top to out, returning its path and the fragment settings to verify
+// with checkKernelConfig. Without fragments it returns the defconfig.
+func (goenv *goenv) mergeKernelConfig(tg *target, src, out, defconfig string) (string, *kconfig, error) {
+	kc, requested, paths, err := goenv.mergeFragments(tg, src, defconfig,
+		true)
+	if err != nil {
+		return "", nil, err
+	}
+	if kc == nil {
+		return defconfig, nil, nil
+	}
+	_, machine := tg.worktree()
+	manifest.setFragments(machine+"/linux", paths)
+	merged := filepath.Join(out, mergedDefconfig)
+	if err = ioutil.WriteFile(merged, kc.bytes(), 0644); err != nil {
+		return "", nil, err
+	}
+	return merged, requested, nil
+}
+
+// mergeFragments returns the defconfig in src with tg's fragments merged
+// in, the settings they request and the fragment files, or a nil kconfig
+// if tg has no fragments. With verbose, the settings the fragments change
+// or contend for are reported.
+func (goenv *goenv) mergeFragments(tg *target, src, defconfig string, verbose bool) (*kconfig, *kconfig, []string, error) {
+	fragments := tg.kernelFragments()
+	if len(fragments) == 0 || *nFlag {
+		return nil, nil, nil, nil
+	}
+	_, machine := tg.worktree()
+	kc, err := readKconfig(filepath.Join(src, defconfig))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	requested := newKconfig()
+	paths := []string{}
+	for _, name := range fragments {
+		fn, err := goenv.findFragment(src, machine, name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		frag, err := readKconfig(fn)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		warnings := requested.merge(frag)
+		changes := kc.merge(frag)
+		if verbose {
+			for _, w := range warnings {
+				fmt.Printf("# %s: warning: %s\n", tg.name, w)
+			}
+			for _, w := range changes {
+				fmt.Printf("# %s: %s\n", tg.name, w)
+			}
+		}
+		paths = append(paths, fn)
+	}
+	return kc, requested, paths, nil
+}
+
+// checkKernelConfig verifies that the settings the fragments requested
+// survived olddefconfig in the .config in out.
+func checkKernelConfig(tg *target, out string, requested *kconfig) error {
+	if requested == nil || *nFlag {
+		return nil
+	}
+	kc, err := readKconfig(filepath.Join(out, ".config"))
+	if err != nil {
+		return err
+	}
+	if unmet := kc.unmet(requested); len(unmet) > 0 {
+		return fmt.Errorf("%s: kernel config fragments not in effect, "+
+			"check their dependencies: %s", tg.name,
+			strings.Join(unmet, ", "))
+	}
+	return nil
+}
+
+// kconfigCommand configures the linux, u-boot or coreboot worktree of a
+// target as a build would, then runs menuconfig in it, shows how its
+// .config differs from the defconfig, or saves it as the defconfig of the
+// source repository.
+func kconfigCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected TARGET menuconfig|diff|savedefconfig")
+	}
+	tg, found := targetMap[args[0]]
+	if !found {
+		return fmt.Errorf("unknown target %s", args[0])
+	}
+	op := args[1]
+	switch op {
+	case "menuconfig", "diff", "savedefconfig":
+	default:
+		return fmt.Errorf("unknown operation %s; "+
+			"use menuconfig, diff or savedefconfig", op)
+	}
+	repo, machine := tg.worktree()
+	if repo == "" {
+		return fmt.Errorf("%s isn't built in a linux, u-boot or "+
+			"coreboot worktree", tg.name)
+	}
+	goenv := tg.env
+	prefix, err := goenv.crossCompile()
+	if err != nil {
+		return err
+	}
+	var src, out, defconfig string
+	var unlock func()
+	if repo == "linux" {
+		if tg, err = kernelTarget(machine); err != nil {
+			return err
+		}
+		if fragments := tg.kernelFragments(); len(fragments) > 0 &&
+			op == "savedefconfig" {
+			return fmt.Errorf("%s merges %s into its .config; "+
+				"edit the defconfig or fragments instead",
+				tg.name, strings.Join(fragments, ", "))
+		}
+		defconfig = goenv.kernelConfigPath + "/" + tg.config
+		src, out, unlock, err = goenv.configKernel(tg, defconfig)
+	} else {
+		defconfig = "configs/" + tg.config
+		src, unlock, err = configWorktree(tg, defconfig,
+			goenv.bootConfigCommand(tg))
+		out = src
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	makeCmd := "make -C " + src +
+		" ARCH=" + goenv.kernelArch +
+		" CROSS_COMPILE=" + prefix
+	if out != src {
+		makeCmd += " O=" + out
+	}
+	if op == "menuconfig" {
+		if err = shellCommandTerminal(makeCmd + " menuconfig"); err != nil {
+			return err
+		}
+		fmt.Printf("# kconfig %s savedefconfig writes %s/.config "+
+			"to %s\n", args[0], out, defconfig)
+		return nil
+	}
+	// savedefconfig writes the minimal defconfig of .config to
+	// defconfig in the output directory.
+	if err = shellCommandRun(makeCmd + " savedefconfig"); err != nil {
+		return err
+	}
+	saved := filepath.Join(out, "defconfig")
+	if op == "diff" {
+		return shellCommandTerminal("if diff -u" +
+			" --label " + defconfig +
+			" --label .config " +
+			filepath.Join(src, defconfig) + " " + saved +
+			"; then echo '# .config matches " + defconfig + "'" +
+			"; else [ $? -eq 1 ]; fi")
+	}
+	// Worktrees are detached and checked out anew as their ref moves,
+	// so the defconfig goes to the source clone to be committed there.
+	gitdir, err := findGitdir(repo)
+	if err != nil {
+		return err
+	}
+	dst, note := filepath.Join(gitdir, defconfig), "review and commit it"
+	if isBareRepo(gitdir) {
+		dst = filepath.Join(src, defconfig)
+		note = gitdir + " is bare; copy it to a clone to commit it"
+	}
+	if err = shellCommandRun("cp " + saved + " " + dst); err != nil {
+		return err
+	}
+	fmt.Printf("# wrote %s; %s\n", dst, note)
+	return nil
+}
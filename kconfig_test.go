@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKconfigMerge(t *testing.T) {
+	kc := parseKconfig("base_defconfig", []byte(
+		"CONFIG_A=y\n# CONFIG_B is not set\nCONFIG_C=\"x\"\n"))
+	frag := parseKconfig("debug.config", []byte(
+		"# comment\nCONFIG_B=y\nCONFIG_C=\"x\"\n# CONFIG_A is not set\n"+
+			"CONFIG_D=m\n"))
+	warnings := kc.merge(frag)
+	want := []string{
+		"debug.config: CONFIG_B=y overrides # CONFIG_B is not set " +
+			"from base_defconfig",
+		"debug.config: # CONFIG_A is not set overrides CONFIG_A=y " +
+			"from base_defconfig",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Errorf("warnings = %q, want %q", warnings, want)
+	}
+	merged := "# CONFIG_A is not set\nCONFIG_B=y\nCONFIG_C=\"x\"\n" +
+		"CONFIG_D=m\n"
+	if got := string(kc.bytes()); got != merged {
+		t.Errorf("merged = %q, want %q", got, merged)
+	}
+
+	config := parseKconfig(".config", []byte(
+		"CONFIG_B=y\nCONFIG_C=\"x\"\n# CONFIG_D is not set\n"))
+	unmet := config.unmet(frag)
+	if !reflect.DeepEqual(unmet,
+		[]string{"CONFIG_D=m (from debug.config)"}) {
+		t.Errorf("unmet = %q", unmet)
+	}
+}
@@ -0,0 +1,213 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kernels are built out of tree, with make O=BUILDDIR/MACHINE, from linux
+// worktrees shared by every machine built from the same commit and patch
+// series. The shared worktrees are in -worktrees/linux/KEY, where KEY is
+// the abbreviated commit followed by an abbreviated hash of the series.
+const sharedLinux = "linux"
+
+// kernelTarget returns the kernel target of machine, whose ref and patch
+// series select its linux worktree.
+func kernelTarget(machine string) (*target, error) {
+	tg, found := targetMap[machine+".vmlinuz"]
+	if !found {
+		return nil, fmt.Errorf("no kernel target for %s", machine)
+	}
+	return tg, nil
+}
+
+// linuxWorktree returns the shared linux worktree the kernel target tg is
+// built from, the commit it is checked out at and the patch series
+// applied to it. The worktree may not exist yet.
+func linuxWorktree(tg *target) (workdir, base string, series *patchSeries, err error) {
+	_, machine := tg.worktree()
+	gitdir, err := findGitdir("linux")
+	if err != nil {
+		return
+	}
+	if base, err = worktreeBase("linux", machine, gitdir); err != nil {
+		return
+	}
+	if base == "" {
+		// Follow the HEAD of the linux repository.
+		base, _ = resolveRef(gitdir, "HEAD")
+	}
+	if series, err = loadPatchSeries(tg.patchDir()); err != nil {
+		return
+	}
+	key := "HEAD" // -n
+	if len(base) >= 12 {
+		key = base[:12]
+	}
+	if series != nil {
+		key += "-" + series.hash[:8]
+	}
+	workdir = filepath.Join(*worktreePath, sharedLinux, key)
+	return
+}
+
+// kernelSource returns the linux worktree the kernel of machine is built
+// from.
+func kernelSource(machine string) (string, error) {
+	tg, err := kernelTarget(machine)
+	if err != nil {
+		return "", err
+	}
+	workdir, _, _, err := linuxWorktree(tg)
+	return workdir, err
+}
+
+// kernelStampFile is the configStamp file of a kernel build directory.
+const kernelStampFile = ".goes-build-config.sha256"
+
+// kernelBuildDir returns the absolute make O= directory of the kernel of
+// machine.
+func kernelBuildDir(machine string) (string, error) {
+	return filepath.Abs(filepath.Join(*buildDirFlag, machine))
+}
+
+// configKernel creates, checks out and patches the shared linux worktree
+// of the kernel target tg, then configures its build directory from the
+// defconfig and tg's config fragments. The build directory is locked until
+// unlock is called.
+func (goenv *goenv) configKernel(tg *target, defconfig string) (src, out string, unlock func(), err error) {
+	_, machine := tg.worktree()
+	workdir, base, series, err := linuxWorktree(tg)
+	if err != nil {
+		return
+	}
+	gitdir, err := findGitdir("linux")
+	if err != nil {
+		return
+	}
+	fmt.Printf("Workdir: %s\n", workdir)
+	if _, err = os.Stat(filepath.Join(workdir, ".git")); os.IsNotExist(err) {
+		if _, err = addWorktree(gitdir, workdir); err != nil {
+			return
+		}
+	} else if err != nil {
+		return
+	}
+	lock, err := lockDir(workdir, "worktree")
+	if err != nil {
+		return
+	}
+	_, err = checkoutWorktree(workdir, base, series)
+	lock.unlock()
+	if err != nil {
+		return
+	}
+	if src, err = filepath.Abs(workdir); err != nil {
+		return
+	}
+	if out, err = kernelBuildDir(machine); err != nil {
+		return
+	}
+	if err = os.MkdirAll(out, 0755); err != nil {
+		return
+	}
+	if lock, err = lockDir(out, "kernel-"+machine); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
+		}
+	}()
+	defconfig, requested, err := goenv.mergeKernelConfig(tg, src, out,
+		defconfig)
+	if err != nil {
+		return
+	}
+	command := goenv.kernelConfigCommand(workdir, out, defconfig)
+	if err = configure(machine+"/linux", src, out, defconfig, command,
+		filepath.Join(out, kernelStampFile), false); err != nil {
+		return
+	}
+	if err = checkKernelConfig(tg, out, requested); err != nil {
+		return
+	}
+	if _, err = checkSourceTree(src); err != nil {
+		return
+	}
+	if !*nFlag {
+		commit, err := shellCommandOutput("cd " + src +
+			" && git rev-parse HEAD")
+		if err != nil {
+			return "", "", nil, err
+		}
+		manifest.setSource(machine+"/linux", commit)
+	}
+	if series != nil {
+		manifest.setPatches(machine+"/linux", series.patches)
+	}
+	return src, out, lock.unlock, nil
+}
+
+// kernelConfigCommand returns the command that makes the .config in the
+// build directory out from defconfig of the shared linux worktree workdir.
+// The source commit is part of the command so that .config is brought up
+// to date with its Kconfig whenever it changes.
+func (goenv *goenv) kernelConfigCommand(workdir, out, defconfig string) string {
+	return "cp " + defconfig + " " + out + "/.config" +
+		" && make O=" + out + " olddefconfig ARCH=" + goenv.kernelArch +
+		" # " + filepath.Base(workdir)
+}
+
+// kernelConfigStamp returns the configStamp configKernel keeps for the
+// .config of the kernel target tg, without changing its build directory.
+func (goenv *goenv) kernelConfigStamp(tg *target) (*configStamp, error) {
+	_, machine := tg.worktree()
+	workdir, _, _, err := linuxWorktree(tg)
+	if err != nil {
+		return nil, err
+	}
+	src, err := filepath.Abs(workdir)
+	if err != nil {
+		return nil, err
+	}
+	out, err := kernelBuildDir(machine)
+	if err != nil {
+		return nil, err
+	}
+	defconfig := goenv.kernelConfigPath + "/" + tg.config
+	kc, _, _, err := goenv.mergeFragments(tg, src, defconfig, false)
+	if err != nil {
+		return nil, err
+	}
+	stamp := filepath.Join(out, kernelStampFile)
+	if kc == nil {
+		return newConfigStamp(filepath.Join(src, defconfig),
+			goenv.kernelConfigCommand(workdir, out, defconfig),
+			stamp)
+	}
+	merged := filepath.Join(out, mergedDefconfig)
+	return configStampOf(kc.bytes(),
+		goenv.kernelConfigCommand(workdir, out, merged), stamp), nil
+}
+
+// inUse reports whether a shared linux worktree is the source of any
+// kernel target.
+func (w *buildWorktree) inUse() bool {
+	for _, tg := range allTargets {
+		if !strings.HasSuffix(tg.name, ".vmlinuz") {
+			continue
+		}
+		if workdir, _, _, err := linuxWorktree(tg); err == nil &&
+			workdir == w.dir {
+			return true
+		}
+	}
+	return false
+}
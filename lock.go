@@ -0,0 +1,213 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// worktreeRepos are the repositories built in worktrees by configWorktree.
+var worktreeRepos = []string{"linux", "u-boot", "coreboot"}
+
+// sourceLock pins the commit of every repository a build uses. It is
+// written by the lock command and, with -locked, read from -lockfile.
+type sourceLock struct {
+	Created time.Time
+	Repos   map[string]*lockedRepo
+}
+
+type lockedRepo struct {
+	Path     string // relative to -platinapath unless outside it
+	Commit   string
+	Describe string `json:",omitempty"`
+}
+
+var (
+	lockOnce sync.Once
+	theLock  *sourceLock
+	lockErr  error
+)
+
+// sourceRepos returns the git repositories the targets are built from,
+// by name, with their paths relative to -platinapath, or absolute if
+// outside it.
+func sourceRepos() (map[string]string, error) {
+	root, err := filepath.Abs(*platinaPath)
+	if err != nil {
+		return nil, err
+	}
+	repos := map[string]string{}
+	add := func(name, dir string) {
+		top, err := shellCommandOutput("cd " + dir +
+			" && git rev-parse --show-toplevel 2>/dev/null")
+		if err != nil {
+			if !isBareRepo(dir) {
+				return
+			}
+			top = dir
+		}
+		if name == "" {
+			name = filepath.Base(top)
+		}
+		rel, err := filepath.Rel(root, top)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			rel = top
+		}
+		repos[name] = rel
+	}
+	for _, tg := range allTargets {
+		if tg.dirName != "" {
+			add("", filepath.Join(root, tg.dirName))
+		}
+	}
+	add("", filepath.Join(root, platinaGoesDir))
+	for _, repo := range worktreeRepos {
+		if gitdir, err := findGitdir(repo); err == nil {
+			add(repo, gitdir)
+		}
+	}
+	return repos, nil
+}
+
+// lockSources writes -lockfile with the HEAD commit of each source
+// repository. Repositories with local changes can't be reproduced and
+// are refused.
+func lockSources(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unexpected %s", strings.Join(args, " "))
+	}
+	repos, err := sourceRepos()
+	if err != nil {
+		return err
+	}
+	if len(repos) == 0 {
+		return fmt.Errorf("no repositories found in %s", *platinaPath)
+	}
+	lock := &sourceLock{
+		Created: time.Now().UTC(),
+		Repos:   map[string]*lockedRepo{},
+	}
+	names := []string{}
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dir := repos[name]
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(*platinaPath, dir)
+		}
+		if !isBareRepo(dir) {
+			dirty, err := gitDirty(dir)
+			if err != nil {
+				return fmt.Errorf("%s: %s", dir, err)
+			}
+			if dirty {
+				return fmt.Errorf("%s has local changes; "+
+					"commit them first", dir)
+			}
+		}
+		commit, err := shellCommandOutput("cd " + dir +
+			" && git rev-parse HEAD")
+		if err != nil {
+			return fmt.Errorf("%s: %s", dir, err)
+		}
+		describe, _ := shellCommandOutput("cd " + dir +
+			" && git describe --tags --always 2>/dev/null")
+		lock.Repos[name] = &lockedRepo{
+			Path:     repos[name],
+			Commit:   commit,
+			Describe: describe,
+		}
+		fmt.Printf("%s\t%s\t%s\n", name, commit, describe)
+	}
+	b, err := json.MarshalIndent(lock, "", "\t")
+	if err != nil {
+		return err
+	}
+	host.log("{lock}write", *lockFileFlag)
+	return ioutil.WriteFile(*lockFileFlag, append(b, '\n'), 0644)
+}
+
+// lockedSources returns the -lockfile source lock if building -locked,
+// otherwise nil.
+func lockedSources() (*sourceLock, error) {
+	if !*lockedFlag {
+		return nil, nil
+	}
+	lockOnce.Do(func() {
+		var b []byte
+		if b, lockErr = ioutil.ReadFile(*lockFileFlag); lockErr != nil {
+			return
+		}
+		theLock = &sourceLock{}
+		if lockErr = json.Unmarshal(b, theLock); lockErr != nil {
+			lockErr = fmt.Errorf("%s: %s", *lockFileFlag, lockErr)
+		}
+	})
+	return theLock, lockErr
+}
+
+// lockedCommit returns the commit repo is locked at, or the empty string
+// if not building -locked.
+func lockedCommit(repo string) (string, error) {
+	lock, err := lockedSources()
+	if lock == nil || err != nil {
+		return "", err
+	}
+	lr, found := lock.Repos[repo]
+	if !found {
+		return "", fmt.Errorf("%s isn't in %s", repo, *lockFileFlag)
+	}
+	return lr.Commit, nil
+}
+
+// checkLockedTree checks the git tree containing dir out at its locked
+// commit when building -locked. A tree with local changes, which the
+// checkout would carry along or refuse, is left to the user.
+func checkLockedTree(dir string) error {
+	if !*lockedFlag || *nFlag {
+		return nil
+	}
+	top, err := shellCommandOutput("cd " + dir +
+		" && git rev-parse --show-toplevel")
+	if err != nil {
+		return fmt.Errorf("%s: %s", dir, err)
+	}
+	want, err := lockedCommit(filepath.Base(top))
+	if err != nil {
+		return err
+	}
+	lock, err := lockDir(top, "checkout")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	head, err := shellCommandOutput("cd " + top + " && git rev-parse HEAD")
+	if err != nil {
+		return fmt.Errorf("%s: %s", top, err)
+	}
+	if head == want {
+		return nil
+	}
+	dirty, err := gitDirty(top)
+	if err != nil {
+		return fmt.Errorf("%s: %s", top, err)
+	}
+	if dirty {
+		return fmt.Errorf("%s is at %s, locked at %s, and has local "+
+			"changes; commit or stash them first", top, head, want)
+	}
+	fmt.Printf("# %s: checking out locked commit %s\n", top, want)
+	return shellCommandRun("cd " + top +
+		" && git checkout -q --detach " + want)
+}
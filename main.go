@@ -58,12 +58,29 @@ type target struct {
 	bootRoot     string
 	built        bool
 	tags         string
+	env          *goenv
+	needs        []string
+	goVersion    string
+	goflags      goflags
+	userTags     map[string]goflags // accepted -tags
+
+	variants       []string      // instrumented variants, see -variant
+	sizeBudget     int64         // max size of kernel or archive
+	legacyBudget   int64         // sizeBudget with -legacy flash layout
+	binaryBudget   int64         // max size of stripped goes binary
+	testTimeout    time.Duration // run time limit of a test binary
+	testPrivileged bool          // test binary must run as root
+	kernel         *target       // kernel whose modules -modules adds
 }
 
 type goenv struct {
 	goarch           string
 	goos             string
+	goVersion        string
+	gnuPrefixes      []string
 	gnuPrefix        string
+	prefixOnce       sync.Once
+	prefixErr        error
 	kernelMakeTarget string
 	kernelPath       string
 	kernelConfigPath string
@@ -75,24 +92,70 @@ type goenv struct {
 
 var (
 	branchFlag = flag.String("branch", "", "branch to check out")
+	repoFlag   = flag.String("repo", "",
+		"NAME=PATH,... source repositories or bare mirrors by name")
+	refFlag = flag.String("ref", "",
+		"REPO=REF,MACHINE/REPO=REF,... refs to check out in worktrees")
+	configFlag = flag.String("config", "goes-build.json",
+		"JSON configuration file")
 	goarchFlag = flag.String("goarch", runtime.GOARCH,
 		"GOARCH of PACKAGE build")
 	goosFlag = flag.String("goos", runtime.GOOS,
 		"GOOS of PACKAGE build")
 	cloneFlag = flag.Bool("clone", false,
 		"Fallback to 'git clone' if git worktree does not work.")
+	goRootsFlag = flag.String("goroots", "",
+		"list of GOROOTs searched for pinned Go versions")
+	goToolchainFlag = flag.Bool("gotoolchain", false,
+		"use GOTOOLCHAIN for pinned Go versions not found in -goroots")
+	goVersionFlag = flag.String("goversion", "",
+		"Go version to build every PACKAGE with")
+	fdtOverlayFlag = flag.Bool("fdtoverlay", false,
+		"apply device tree overlays at build time, not boot time")
+	gnuPrefixFlag = flag.String("gnuprefix", "",
+		"GOARCH=PREFIX,... cross compiler prefixes (default: search PATH)")
+	lockedFlag = flag.Bool("locked", false,
+		"build from the commits pinned in -lockfile")
+	lockFileFlag = flag.String("lockfile", "goes-build.lock",
+		"source lock file written by the lock command")
 	legacyFlag = flag.Bool("legacy", false,
 		"Use legacy flash layout.")
+	manifestFlag = flag.String("manifest", "goes-build-manifest.json",
+		"file to record the build manifest in")
+	releaseFlag = flag.Bool("release", false,
+		"build a release; refuse dirty or untagged source trees.")
+	modulesFlag = flag.Bool("modules", false,
+		"add the modules of their kernels to initramfs archives")
+	mirrorsFlag = flag.String("mirrors", "mirrors",
+		"path to the bare repository mirrors made by the mirror command")
 	nFlag = flag.Bool("n", false,
 		"print 'go build' commands but do not run them.")
-	oFlag       = flag.String("o", "", "output file name of PACKAGE build")
+	offlineFlag = flag.Bool("offline", false,
+		"create worktrees only from -mirrors; never fetch")
+	oFlag        = flag.String("o", "", "output file name of PACKAGE build")
+	sizeBaseFlag = flag.String("sizebase", "",
+		"directory of a previous build's size reports to compare with")
+	sizeReportFlag = flag.String("sizereport", "",
+		"directory to write goes binary size reports to")
+	testOutFlag = flag.String("testout", "test-results",
+		"directory for test2json and JUnit XML test results")
 	platinaPath = flag.String("platinapath", "..", "path to Platina sources")
-	tagsFlag    = flag.String("tags", "", `
-debug	disable optimizer and increase vnet log
-diag	include manufacturing diagnostics with BMC
+	vulnDBFlag  = flag.String("vulndb", "",
+		"directory of an offline Go vulnerability database")
+	vulnFailFlag = flag.Bool("vulnfail", false,
+		"fail a -release build whose goes binaries are vulnerable")
+	variantFlag = flag.String("variant", "",
+		"build instrumented race or cover variants of PACKAGEs")
+	covOutFlag = flag.String("covout", "coverage",
+		"directory to merge coverage data into")
+	tagsFlag = flag.String("tags", "", `tags accepted by TARGETs:
+debug	disable optimizer and increase vnet log; merge debug.config into kernels
+diag	include manufacturing diagnostics in BMC goes binaries
 `)
 	worktreePath = flag.String("worktrees", "worktrees",
 		"path to where to create worktrees for build")
+	buildDirFlag = flag.String("builddir", "build",
+		"path to where to build kernels out of tree")
 	xFlag = flag.Bool("x", false, "print 'go build' commands.")
 	vFlag = flag.Bool("v", false,
 		"print the names of packages as they are compiled.")
@@ -104,18 +167,23 @@ diag	include manufacturing diagnostics with BMC
 	amd64Linux = goenv{
 		goarch:           "amd64",
 		goos:             "linux",
-		gnuPrefix:        "x86_64-linux-gnu-",
+		goVersion:        "go1.14",
 		kernelMakeTarget: "bzImage",
 		kernelPath:       "arch/x86/boot/bzImage",
 		kernelConfigPath: "arch/x86/configs",
 		kernelArch:       "x86_64",
 		boot:             "coreboot",
 		cpioSuffix:       ".cpio.xz",
+		gnuPrefixes: []string{
+			"x86_64-linux-gnu-",
+			"x86_64-pc-linux-gnu-",
+			"x86_64-unknown-linux-gnu-",
+		},
 	}
 	armLinux = goenv{
 		goarch:           "arm",
 		goos:             "linux",
-		gnuPrefix:        "arm-linux-gnueabi-",
+		goVersion:        "go1.14",
 		kernelMakeTarget: "zImage dtbs",
 		kernelPath:       "arch/arm/boot/zImage",
 		kernelConfigPath: "arch/arm/configs",
@@ -123,6 +191,12 @@ diag	include manufacturing diagnostics with BMC
 		boot:             "u-boot",
 		cpioSuffix:       ".cpio.xz",
 		cpioTrimPrefix:   "goes-",
+		gnuPrefixes: []string{
+			"arm-linux-gnueabi-",
+			"arm-linux-gnueabihf-",
+			"arm-unknown-linux-gnueabi-",
+			"arm-unknown-linux-gnueabihf-",
+		},
 	}
 
 	corebootExampleAmd64Config  = "example-amd64_defconfig"
@@ -168,9 +242,21 @@ diag	include manufacturing diagnostics with BMC
 	allTargets = []*target{}
 	targetMap  = map[string]*target{}
 
-	worktreeMutex = &sync.Mutex{}
+	gnuPrefixes = map[string]string{}
+
+	commandList = []*command{}
+	commands    = map[string]*command{}
 )
 
+// command is a goes-build subcommand, run instead of making targets when
+// its name is the first argument.
+type command struct {
+	name string
+	args string
+	help string
+	run  func(args []string) error
+}
+
 func init() {
 	flag.Usage = usage
 
@@ -178,6 +264,8 @@ func init() {
 		name:   "coreboot-example-amd64",
 		maker:  makeAmd64Boot,
 		config: corebootExampleAmd64Config,
+		env:    &amd64Linux,
+		needs:  corebootNeeds,
 	}
 
 	corebootExampleAmd64Rom = &target{
@@ -186,12 +274,15 @@ func init() {
 		config:   corebootExampleAmd64Machine,
 		def:      true,
 		bootRoot: "goes-bootrom.cpio.xz",
+		env:      &amd64Linux,
 	}
 
 	corebootPlatinaMk1 = &target{
 		name:   "coreboot-platina-mk1",
 		maker:  makeAmd64Boot,
 		config: corebootPlatinaMk1Config,
+		env:    &amd64Linux,
+		needs:  corebootNeeds,
 	}
 
 	corebootPlatinaMk1Rom = &target{
@@ -200,11 +291,14 @@ func init() {
 		config:   corebootPlatinaMk1Machine,
 		def:      true,
 		bootRoot: "goes-bootrom-platina-mk1.cpio.xz",
+		env:      &amd64Linux,
 	}
 
 	debianControl = &target{
 		name:  "debian/control",
 		maker: makeAmd64DebianControl,
+		env:   &amd64Linux,
+		needs: debianControlNeeds,
 	}
 
 	exampleAmd64Deb = &target{
@@ -212,127 +306,203 @@ func init() {
 		maker:  makeAmd64LinuxKernelDeb,
 		config: "platina-example-amd64_defconfig",
 		def:    true,
+		env:    &amd64Linux,
+		needs:  kernelDebNeeds,
 	}
 
 	exampleAmd64BootromVmlinuz = &target{
-		name:   "example-amd64-bootrom.vmlinuz",
-		maker:  makeAmd64LinuxKernel,
-		config: "platina-example-amd64_defconfig",
-		def:    true,
+		name:     "example-amd64-bootrom.vmlinuz",
+		maker:    makeAmd64LinuxKernel,
+		config:   "platina-example-amd64_defconfig",
+		def:      true,
+		env:      &amd64Linux,
+		needs:    kernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	exampleAmd64Vmlinuz = &target{
-		name:   "example-amd64.vmlinuz",
-		maker:  makeAmd64LinuxKernel,
-		config: "platina-example-amd64_defconfig",
-		def:    true,
+		name:     "example-amd64.vmlinuz",
+		maker:    makeAmd64LinuxKernel,
+		config:   "platina-example-amd64_defconfig",
+		def:      true,
+		env:      &amd64Linux,
+		needs:    kernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	goesBoot = &target{
-		name:    "goes-boot",
-		maker:   makeAmd64LinuxInitramfs,
-		dirName: platinaGoesMainGoesBootDir,
+		name:     "goes-boot",
+		maker:    makeAmd64LinuxInitramfs,
+		dirName:  platinaGoesMainGoesBootDir,
+		env:      &amd64Linux,
+		needs:    initramfsNeeds,
+		variants: []string{variantCover},
+		userTags: goUserTags,
 	}
 
 	goesBootPlatinaMk1 = &target{
-		name:    "goes-boot-platina-mk1",
-		maker:   makeAmd64LinuxInitramfs,
-		dirName: platinaGoesMainGoesBootDir,
-		tags:    "mk1",
+		name:     "goes-boot-platina-mk1",
+		maker:    makeAmd64LinuxInitramfs,
+		dirName:  platinaGoesMainGoesBootDir,
+		tags:     "mk1",
+		env:      &amd64Linux,
+		needs:    initramfsNeeds,
+		variants: []string{variantCover},
+		userTags: goUserTags,
 	}
 
 	goesBootrom = &target{
-		name:    "goes-bootrom",
-		maker:   makeAmd64LinuxInitramfs,
-		dirName: platinaGoesMainGoesBootDir,
-		tags:    "bootrom",
+		name:     "goes-bootrom",
+		maker:    makeAmd64LinuxInitramfs,
+		dirName:  platinaGoesMainGoesBootDir,
+		tags:     "bootrom",
+		env:      &amd64Linux,
+		needs:    initramfsNeeds,
+		variants: []string{variantCover},
+		userTags: goUserTags,
 	}
 
 	goesBootromPlatinaMk1 = &target{
-		name:    "goes-bootrom-platina-mk1",
-		maker:   makeAmd64LinuxInitramfs,
-		dirName: platinaGoesMainGoesBootDir,
-		tags:    "bootrom,mk1",
+		name:     "goes-bootrom-platina-mk1",
+		maker:    makeAmd64LinuxInitramfs,
+		dirName:  platinaGoesMainGoesBootDir,
+		tags:     "bootrom,mk1",
+		env:      &amd64Linux,
+		needs:    initramfsNeeds,
+		variants: []string{variantCover},
+		userTags: goUserTags,
 	}
 
 	goesBootArm = &target{
-		name:    "goes-boot-arm",
-		maker:   makeArmLinuxInitramfs,
-		dirName: platinaGoesMainGoesBootDir,
+		name:     "goes-boot-arm",
+		maker:    makeArmLinuxInitramfs,
+		dirName:  platinaGoesMainGoesBootDir,
+		env:      &armLinux,
+		needs:    initramfsNeeds,
+		variants: []string{variantCover},
+		userTags: goUserTags,
 	}
 
 	goesExample = &target{
-		name:    "goes-example",
-		maker:   makeHost,
-		dirName: platinaGoesMainGoesExampleDir,
-		def:     true,
+		name:     "goes-example",
+		maker:    makeHost,
+		dirName:  platinaGoesMainGoesExampleDir,
+		def:      true,
+		env:      &host,
+		needs:    goNeeds,
+		userTags: goUserTags,
 	}
 
 	goesExampleArm = &target{
-		name:    "goes-example-arm",
-		maker:   makeArmLinuxStatic,
-		dirName: platinaGoesMainGoesExampleDir,
-		def:     true,
+		name:     "goes-example-arm",
+		maker:    makeArmLinuxStatic,
+		dirName:  platinaGoesMainGoesExampleDir,
+		def:      true,
+		env:      &armLinux,
+		needs:    goNeeds,
+		userTags: goUserTags,
 	}
 
 	goesIP = &target{
-		name:    "goes-ip",
-		maker:   makeHost,
-		dirName: platinaGoesMainIPDir,
+		name:     "goes-ip",
+		maker:    makeHost,
+		dirName:  platinaGoesMainIPDir,
+		env:      &host,
+		needs:    goNeeds,
+		userTags: goUserTags,
 	}
 
 	goesIPTest = &target{
-		name:    "goes-ip.test",
-		maker:   makeHostTest,
-		dirName: platinaGoesMainIPDir,
+		name:           "goes-ip.test",
+		maker:          makeHostTest,
+		dirName:        platinaGoesMainIPDir,
+		env:            &host,
+		needs:          goNeeds,
+		testTimeout:    5 * time.Minute,
+		testPrivileged: true,
+		userTags:       goUserTags,
 	}
 
 	goesPlatinaMk1 = &target{
-		name:    "goes-platina-mk1",
-		maker:   makeGoesPlatinaMk1,
-		dirName: platinaGoesMainGoesPlatinaMk1Dir,
-		def:     true,
+		name:      "goes-platina-mk1",
+		maker:     makeGoesPlatinaMk1,
+		dirName:   platinaGoesMainGoesPlatinaMk1Dir,
+		def:       true,
+		env:       &amd64Linux,
+		needs:     goNeeds,
+		goVersion: "go1.14",
+		goflags:   goflags{ldvars: allLdvars},
+		variants:  []string{variantRace, variantCover},
+		userTags:  goUserTags,
 	}
 
 	goesPlatinaMk1Bmc = &target{
-		name:    "goes-platina-mk1-bmc",
-		maker:   makeArmLinuxInitramfs,
-		dirName: platinaGoesMainGoesPlatinaMk1BmcDir,
+		name:      "goes-platina-mk1-bmc",
+		maker:     makeArmLinuxInitramfs,
+		dirName:   platinaGoesMainGoesPlatinaMk1BmcDir,
+		env:       &armLinux,
+		needs:     initramfsNeeds,
+		goVersion: "go1.14",
+		goflags:   goflags{ldvars: allLdvars},
+		variants:  []string{variantCover},
+		userTags:  bmcUserTags,
 	}
 
 	goesPlatinaMk1Installer = &target{
-		name:    "goes-platina-mk1-installer",
-		maker:   makeGoesPlatinaMk1Installer,
-		dirName: platinaGoesMainGoesPlatinaMk1Dir,
+		name:     "goes-platina-mk1-installer",
+		maker:    makeGoesPlatinaMk1Installer,
+		dirName:  platinaGoesMainGoesPlatinaMk1Dir,
+		env:      &amd64Linux,
+		needs:    installerNeeds,
+		variants: []string{variantRace, variantCover},
+		userTags: goUserTags,
 	}
 
 	goesPlatinaMk1Test = &target{
-		name:    "goes-platina-mk1.test",
-		maker:   makeAmd64LinuxTest,
-		dirName: platinaGoesMainGoesPlatinaMk1Dir,
+		name:           "goes-platina-mk1.test",
+		maker:          makeAmd64LinuxTest,
+		dirName:        platinaGoesMainGoesPlatinaMk1Dir,
+		env:            &amd64Linux,
+		needs:          goNeeds,
+		testTimeout:    30 * time.Minute,
+		testPrivileged: true,
+		userTags:       goUserTags,
 	}
 
 	goesPlatinaMk2Lc1Bmc = &target{
-		name:    "goes-platina-mk2-lc1-bmc",
-		maker:   makeArmLinuxStatic,
-		dirName: platinaGoesMainGoesPlatinaMk2Lc1Bmc,
+		name:     "goes-platina-mk2-lc1-bmc",
+		maker:    makeArmLinuxStatic,
+		dirName:  platinaGoesMainGoesPlatinaMk2Lc1Bmc,
+		env:      &armLinux,
+		needs:    goNeeds,
+		userTags: bmcUserTags,
 	}
 
 	goesPlatinaMk2Mc1Bmc = &target{
-		name:    "goes-platina-mk2-mc1-bmc",
-		maker:   makeArmLinuxStatic,
-		dirName: platinaGoesMainGoesPlatinaMk2Mc1Bmc,
+		name:     "goes-platina-mk2-mc1-bmc",
+		maker:    makeArmLinuxStatic,
+		dirName:  platinaGoesMainGoesPlatinaMk2Mc1Bmc,
+		env:      &armLinux,
+		needs:    goNeeds,
+		userTags: bmcUserTags,
 	}
 
 	itbPlatinaMk1Bmc = &target{
-		name:  "platina-mk1-bmc.itb",
-		maker: makeArmItb,
+		name:         "platina-mk1-bmc.itb",
+		maker:        makeArmItb,
+		env:          &armLinux,
+		needs:        itbNeeds,
+		sizeBudget:   0x00800000,
+		legacyBudget: 0x00500000, // -ker.bin and -ini.bin
 	}
 
 	platinaMk1BmcVmlinuz = &target{
-		name:   "platina-mk1-bmc.vmlinuz",
-		maker:  makeArmLinuxKernel,
-		config: "platina-mk1-bmc_defconfig",
+		name:     "platina-mk1-bmc.vmlinuz",
+		maker:    makeArmLinuxKernel,
+		config:   "platina-mk1-bmc_defconfig",
+		env:      &armLinux,
+		needs:    armKernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	platinaMk1Deb = &target{
@@ -340,49 +510,70 @@ func init() {
 		maker:  makeAmd64LinuxKernelDeb,
 		config: "platina-mk1_defconfig",
 		def:    true,
+		env:    &amd64Linux,
+		needs:  kernelDebNeeds,
 	}
 
 	platinaMk1BootromVmlinuz = &target{
-		name:   "platina-mk1-bootrom.vmlinuz",
-		maker:  makeAmd64LinuxKernel,
-		config: "platina-mk1-bootrom_defconfig",
+		name:     "platina-mk1-bootrom.vmlinuz",
+		maker:    makeAmd64LinuxKernel,
+		config:   "platina-mk1-bootrom_defconfig",
+		env:      &amd64Linux,
+		needs:    kernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	platinaMk1Vmlinuz = &target{
-		name:   "platina-mk1.vmlinuz",
-		maker:  makeAmd64LinuxKernel,
-		config: "platina-mk1_defconfig",
+		name:     "platina-mk1.vmlinuz",
+		maker:    makeAmd64LinuxKernel,
+		config:   "platina-mk1_defconfig",
+		env:      &amd64Linux,
+		needs:    kernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	platinaMk2Lc1BmcVmlinuz = &target{
-		name:   "platina-mk2-lc1-bmc.vmlinuz",
-		maker:  makeArmLinuxKernel,
-		config: "platina-mk2-lc1-bmc_defconfig",
+		name:     "platina-mk2-lc1-bmc.vmlinuz",
+		maker:    makeArmLinuxKernel,
+		config:   "platina-mk2-lc1-bmc_defconfig",
+		env:      &armLinux,
+		needs:    armKernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	platinaMk2Mc1BmcVmlinuz = &target{
-		name:   "platina-mk2-mc1-bmc.vmlinuz",
-		maker:  makeArmLinuxKernel,
-		config: "platina-mk2-mc1-bmc_defconfig",
+		name:     "platina-mk2-mc1-bmc.vmlinuz",
+		maker:    makeArmLinuxKernel,
+		config:   "platina-mk2-mc1-bmc_defconfig",
+		env:      &armLinux,
+		needs:    armKernelNeeds,
+		userTags: kernelUserTags,
 	}
 
 	ubootPlatinaMk1Bmc = &target{
 		name:   "u-boot-platina-mk1-bmc",
 		maker:  makeArmBoot,
 		config: "platinamx6boards_qspi_defconfig",
+		env:    &armLinux,
+		needs:  ubootNeeds,
 	}
 
 	vnetPlatinaMk1 = &target{
-		name:    "vnet-platina-mk1",
-		maker:   makeAmd64LinuxStatic,
-		dirName: platinaVnetMk1Dir,
-		def:     true,
+		name:     "vnet-platina-mk1",
+		maker:    makeAmd64LinuxStatic,
+		dirName:  platinaVnetMk1Dir,
+		def:      true,
+		env:      &amd64Linux,
+		needs:    goNeeds,
+		userTags: goUserTags,
 	}
 
 	zipPlatinaMk1Bmc = &target{
 		name:  "platina-mk1-bmc.zip",
 		maker: makeArmZipfile,
 		def:   true,
+		env:   &armLinux,
+		needs: zipNeeds,
 	}
 
 	// Set up dependencies. We have to do this after we have set up all
@@ -419,6 +610,11 @@ func init() {
 		platinaMk1Vmlinuz,
 	}
 
+	// The kernels booting initramfs targets, for -modules.
+	goesBootrom.kernel = exampleAmd64BootromVmlinuz
+	goesBootromPlatinaMk1.kernel = platinaMk1BootromVmlinuz
+	goesPlatinaMk1Bmc.kernel = platinaMk1BmcVmlinuz
+
 	zipPlatinaMk1Bmc.dependencies = []*target{
 		itbPlatinaMk1Bmc,
 		ubootPlatinaMk1Bmc,
@@ -466,6 +662,62 @@ func init() {
 		}
 		targetMap[t.name] = t
 	}
+
+	// Set up the list of commands
+
+	commandList = []*command{
+		{
+			name: "doctor",
+			args: "[ TARGET... ]",
+			help: "check that the tools and sources TARGETs need are present",
+			run:  doctor,
+		},
+		{
+			name: "covdata",
+			args: "DIR...",
+			help: "merge GOCOVERDIR data from test boots into -covout",
+			run:  collectCoverage,
+		},
+		{
+			name: "test",
+			args: "[ TARGET... ]",
+			help: "build and run test binaries, writing JUnit XML",
+			run:  runTests,
+		},
+		{
+			name: "vulncheck",
+			args: "TARGET...",
+			help: "scan goes binaries of TARGETs against -vulndb",
+			run:  vulncheck,
+		},
+		{
+			name: "worktree",
+			args: "list|status|reset|prune|rm [-f] [MACHINE[/REPO]...]",
+			help: "manage the build worktrees under -worktrees",
+			run:  worktreeCommand,
+		},
+		{
+			name: "lock",
+			args: "",
+			help: "pin the HEAD commit of each source repository in -lockfile",
+			run:  lockSources,
+		},
+		{
+			name: "kconfig",
+			args: "TARGET menuconfig|diff|savedefconfig",
+			help: "edit, compare or save the .config of TARGET's worktree",
+			run:  kconfigCommand,
+		},
+		{
+			name: "mirror",
+			args: "[ REPO... ]",
+			help: "create or refresh bare mirrors of local clones in -mirrors",
+			run:  mirrorRepos,
+		},
+	}
+	for _, cmd := range commandList {
+		commands[cmd.name] = cmd
+	}
 }
 
 func makeTargets(parent string, targets []*target) {
@@ -514,33 +766,129 @@ func makeTargets(parent string, targets []*target) {
 
 func main() {
 	flag.Parse()
-	targetsReq := flag.Args()
+	configSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			configSet = true
+		}
+	})
+	if err := loadConfig(*configFlag, configSet); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var err error
+	if gnuPrefixes, err = parseKeyValues(gnuPrefixes,
+		*gnuPrefixFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "-gnuprefix:", err)
+		os.Exit(1)
+	}
+	if repoPaths, err = parseKeyValues(repoPaths, *repoFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "-repo:", err)
+		os.Exit(1)
+	}
+	for k, v := range cfg.Refs {
+		repoRefs[k] = v
+	}
+	if repoRefs, err = parseKeyValues(repoRefs, *refFlag); err != nil {
+		fmt.Fprintln(os.Stderr, "-ref:", err)
+		os.Exit(1)
+	}
+	if *lockedFlag && (*branchFlag != "" || len(repoRefs) > 0) {
+		fmt.Fprintln(os.Stderr, "-branch and -ref can't be used -locked")
+		os.Exit(1)
+	}
+	if *offlineFlag {
+		if *goToolchainFlag {
+			fmt.Fprintln(os.Stderr, "-gotoolchain can't be used -offline")
+			os.Exit(1)
+		}
+		// Refuse any git transport but local paths, and any module
+		// or Go toolchain download.
+		os.Setenv("GIT_ALLOW_PROTOCOL", "file")
+		os.Setenv("GOPROXY", "off")
+		os.Setenv("GOTOOLCHAIN", "local")
+	}
+	addKernelDependencies()
+	args := flag.Args()
+	if len(args) > 0 {
+		if cmd, found := commands[args[0]]; found {
+			if err := cmd.run(args[1:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", cmd.name, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	tgs, err := selectTargets(args)
+	if err != nil {
+		panic(err)
+	}
+	if err = checkTags(tgs); err != nil {
+		panic(err)
+	}
+	if err = checkVariant(tgs); err != nil {
+		panic(err)
+	}
+	if err = checkRefs(tgs); err != nil {
+		panic(err)
+	}
+	manifest.Started = time.Now()
+	manifest.Variant = *variantFlag
+	if *lockedFlag {
+		manifest.Lock = *lockFileFlag
+	}
+	for _, tg := range tgs {
+		manifest.Targets = append(manifest.Targets, tg.name)
+	}
+	lock, err := lockOutputs()
+	if err != nil {
+		panic(err)
+	}
+	makeTargets("", tgs)
+	if !*nFlag {
+		if err := manifest.write(*manifestFlag); err != nil {
+			panic(err)
+		}
+	}
+	lock.unlock()
+}
+
+// selectTargets returns the targets named on the command line, the
+// default targets if none are named, or every target for "all".
+func selectTargets(names []string) ([]*target, error) {
 	tgs := make([]*target, 0)
-	if len(targetsReq) == 0 {
+	if len(names) == 0 {
 		for _, t := range allTargets {
 			if t.def {
 				tgs = append(tgs, t)
 			}
 		}
-	} else if targetsReq[0] == "all" {
+	} else if names[0] == "all" {
 		tgs = allTargets
 	} else {
-		for _, t := range targetsReq {
+		for _, t := range names {
 			if tg, p := targetMap[t]; p {
 				tgs = append(tgs, tg)
 			} else {
-				panic("Unknown target " + t)
+				return nil, fmt.Errorf("Unknown target %s", t)
 			}
 		}
 	}
-	makeTargets("", tgs)
+	return tgs, nil
 }
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "usage:", os.Args[0],
 		"[ OPTION... ] [ TARGET... | PACKAGE ]")
+	fmt.Fprintln(os.Stderr, "      ", os.Args[0],
+		"[ OPTION... ] COMMAND [ ARG... ]")
 	fmt.Fprintln(os.Stderr, "\nOptions:")
 	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, cmd := range commandList {
+		fmt.Fprintf(os.Stderr, "\t%s %s\n\t\t%s\n", cmd.name, cmd.args,
+			cmd.help)
+	}
 	fmt.Fprintln(os.Stderr, "\nDefault Targets:")
 	for _, t := range allTargets {
 		if t.def {
@@ -549,7 +897,12 @@ func usage() {
 	}
 	fmt.Fprintln(os.Stderr, "\n\"all\" Targets:")
 	for _, t := range allTargets {
-		fmt.Fprint(os.Stderr, "\t", t.name, "\n")
+		if tags := t.acceptedTags(); len(tags) > 0 {
+			fmt.Fprintf(os.Stderr, "\t%s [-tags %s]\n", t.name,
+				strings.Join(tags, ","))
+		} else {
+			fmt.Fprint(os.Stderr, "\t", t.name, "\n")
+		}
 	}
 }
 
@@ -559,7 +912,7 @@ func makeArmLinuxStatic(tg *target) error {
 
 func makeArmBoot(tg *target) (err error) {
 	machine := strings.TrimPrefix(tg.name, "u-boot-")
-	if err = armLinux.makeboot(tg.name, "make "+tg.config); err != nil {
+	if err = armLinux.makeboot(tg); err != nil {
 		return err
 	}
 	env, err := makeUbootEnv()
@@ -581,12 +934,29 @@ func makeArmBoot(tg *target) (err error) {
 func makeArmItb(tg *target) (err error) {
 	machine := strings.TrimSuffix(tg.name, ".itb")
 
-	cmdline := "cp " + filepath.Join(*platinaPath,
-		platinaGoesMainGoesPlatinaMk1BmcDir,
-		"goes-bmc.its") +
-		" goes-bmc.its.tmp && " +
-		"mkimage -f goes-bmc.its.tmp " +
-		machine + "-itb.bin"
+	template := filepath.Join(*platinaPath,
+		platinaGoesMainGoesPlatinaMk1BmcDir, "goes-bmc.its")
+	trees, err := itsTrees(machine)
+	if err != nil {
+		return
+	}
+	cmdline := "cp " + template + " goes-bmc.its.tmp && "
+	if len(trees) > 0 && !*nFlag {
+		b, err := ioutil.ReadFile(template)
+		if err != nil {
+			return err
+		}
+		its, err := extendITS(string(b), trees)
+		if err != nil {
+			return fmt.Errorf("%s: %s", template, err)
+		}
+		if err = ioutil.WriteFile("goes-bmc.its.tmp", []byte(its),
+			0644); err != nil {
+			return err
+		}
+		cmdline = ""
+	}
+	cmdline += "mkimage -f goes-bmc.its.tmp " + machine + "-itb.bin"
 	err = shellCommandRun(cmdline)
 	if err != nil {
 		return
@@ -596,13 +966,24 @@ func makeArmItb(tg *target) (err error) {
 	if err != nil {
 		return
 	}
-	limit := int64(0x00800000)
+	limit := tg.budget()
 	kind := ""
 	if *legacyFlag {
-		limit = 0x00500000
 		kind = "legacy "
 	}
-	if s.Size() > limit {
+	if limit > 0 && s.Size() > limit {
+		for _, fn := range []string{machine + ".vmlinuz",
+			machine + ".cpio.xz", machine + "-dtb.bin"} {
+			if fi, err := os.Stat(fn); err == nil {
+				fmt.Printf("# %10d %s\n", fi.Size(), fn)
+			}
+		}
+		if *sizeReportFlag != "" {
+			if r, err := readSizeReport(filepath.Join(*sizeReportFlag,
+				goesPlatinaMk1Bmc.output()+".size.json")); err == nil {
+				r.print(20)
+			}
+		}
 		return fmt.Errorf("ITB size of %d exceeds %slimit of %d",
 			s.Size(), kind, limit)
 	}
@@ -730,13 +1111,11 @@ func makeArmLinuxKernel(tg *target) (err error) {
 	if err != nil {
 		return
 	}
-	dtb := filepath.Join(*worktreePath, machine, "linux",
-		"arch/arm/boot/dts/", machine+".dtb")
-	cmdline := "cp " + dtb + " " + machine + "-dtb.bin"
-	if err = shellCommandRun(cmdline); err != nil {
-		return err
+	out, err := kernelBuildDir(machine)
+	if err != nil {
+		return
 	}
-	return
+	return installDeviceTrees(tg, out)
 }
 
 func makeArmLinuxInitramfs(tg *target) (err error) {
@@ -745,12 +1124,14 @@ func makeArmLinuxInitramfs(tg *target) (err error) {
 		return
 	}
 	err = armLinux.makeCpioArchive(tg)
-
-	return
+	if err != nil {
+		return
+	}
+	return checkFileSize(tg, armLinux.cpioName(tg))
 }
 
 func makeAmd64Boot(tg *target) (err error) {
-	return amd64Linux.makeboot(tg.name, "MAKEINFO=missing make crossgcc-i386 && make "+tg.config)
+	return amd64Linux.makeboot(tg)
 }
 
 func makeAmd64Linux(tg *target) error {
@@ -802,7 +1183,11 @@ func makeAmd64LinuxInitramfs(tg *target) (err error) {
 	if err != nil {
 		return
 	}
-	return amd64Linux.makeCpioArchive(tg)
+	err = amd64Linux.makeCpioArchive(tg)
+	if err != nil {
+		return
+	}
+	return checkFileSize(tg, amd64Linux.cpioName(tg))
 }
 
 func makeHost(tg *target) error {
@@ -814,22 +1199,19 @@ func makeHostTest(tg *target) error {
 }
 
 func makeGoesPlatinaMk1(tg *target) error {
-	args := []string{}
-	if strings.Index(*tagsFlag, "debug") >= 0 {
-		args = append(args, "-gcflags", "-N -l")
-	}
-	return amd64Linux.goDoForPkg(goesPlatinaMk1, "build", "", "", args...)
+	return amd64Linux.goDoForPkg(goesPlatinaMk1, "build", "", "")
 }
 
 func makeGoesPlatinaMk1Installer(tg *target) error {
 	var zfiles []string
-	tinstaller := tg.name + ".tmp"
-	tzip := goesPlatinaMk1.name + ".zip"
+	installer := tg.output()
+	tinstaller := installer + ".tmp"
+	tzip := goesPlatinaMk1.output() + ".zip"
 	err := makeGoesPlatinaMk1(tg)
 	if err != nil {
 		return err
 	}
-	err = amd64Linux.goDoInDir(tg.dirName, "build", "-o", tinstaller,
+	err = amd64Linux.goDoInDir(tg, tg.dirName, "build", "-o", tinstaller,
 		platinaGoesMainGoesInstaller)
 	if err != nil {
 		return err
@@ -841,29 +1223,34 @@ func makeGoesPlatinaMk1Installer(tg *target) error {
 	}
 	zfiles = append(zfiles, fi.Name())
 
-	err = zipfile(tzip, append(zfiles, goesPlatinaMk1.name))
+	err = zipfile(tzip, append(zfiles, goesPlatinaMk1.output()))
 	if err != nil {
 		return err
 	}
-	err = catto(tg.name, tinstaller, tzip)
+	err = catto(installer, tinstaller, tzip)
 	if err != nil {
 		return err
 	}
 	if err = rm(tinstaller, tzip); err != nil {
 		return err
 	}
-	if err = zipa(tg.name); err != nil {
+	if err = zipa(installer); err != nil {
 		return err
 	}
-	return chmodx(tg.name)
+	return chmodx(installer)
+}
+
+// cpioName returns the file name of the initramfs archive of tg.
+func (goenv *goenv) cpioName(tg *target) string {
+	return strings.TrimPrefix(tg.output()+goenv.cpioSuffix,
+		goenv.cpioTrimPrefix)
 }
 
 func (goenv *goenv) makeCpioArchive(tg *target) (err error) {
 	if *nFlag {
 		return nil
 	}
-	arname := strings.TrimPrefix(tg.name+goenv.cpioSuffix,
-		goenv.cpioTrimPrefix)
+	arname := goenv.cpioName(tg)
 	f, err := os.Create(arname + ".tmp")
 	if err != nil {
 		return
@@ -945,7 +1332,7 @@ func (goenv *goenv) makeCpioArchive(tg *target) (err error) {
 		return
 	}
 
-	goesbin, err := goenv.stripBinary(filepath.Join(*platinaPath, tg.dirName, tg.name))
+	goesbin, err := goenv.stripBinary(filepath.Join(*platinaPath, tg.dirName, tg.output()))
 	if err != nil {
 		return
 	}
@@ -956,6 +1343,9 @@ func (goenv *goenv) makeCpioArchive(tg *target) (err error) {
 	if err = mklinkCpio(w, "init", "sbin/"+tg.name); err != nil {
 		return
 	}
+	if *modulesFlag && tg.kernel != nil {
+		err = addKernelModules(w, tg)
+	}
 	return
 }
 
@@ -1008,18 +1398,22 @@ func mkfileFromHostCpio(w *cpio.Writer, tname string, mode os.FileMode, hname st
 	return mkfileFromSliceCpio(w, tname, mode, hname, data)
 }
 
-func (goenv *goenv) goDoInDir(dir string, args ...string) error {
-	if len(*tagsFlag) > 0 {
+func (goenv *goenv) goDoInDir(tg *target, dir string, args ...string) error {
+	tc, err := goenv.goToolchain(tg)
+	if err != nil {
+		return err
+	}
+	manifest.setGoVersion(tg.name, tc.version)
+	if tags := strings.Join(tg.activeUserTags(), ","); len(tags) > 0 {
 		done := false
 		for i, arg := range args {
 			if arg == "-tags" {
-				args[i+1] = fmt.Sprint(args[i+1], " ",
-					*tagsFlag)
+				args[i+1] = fmt.Sprint(args[i+1], ",", tags)
 				done = true
 			}
 		}
 		if !done {
-			args = append([]string{args[0], "-tags", *tagsFlag},
+			args = append([]string{args[0], "-tags", tags},
 				args[1:]...)
 		}
 	}
@@ -1032,9 +1426,9 @@ func (goenv *goenv) goDoInDir(dir string, args ...string) error {
 	if *xFlag {
 		args = append([]string{args[0], "-x"}, args[1:]...)
 	}
-	cmd := exec.Command("go", args...)
+	cmd := exec.Command(tc.path, args...)
 	cmd.Dir = filepath.Join(*platinaPath, dir)
-	cmd.Env = os.Environ()
+	cmd.Env = append(os.Environ(), tc.env...)
 	if goenv.goarch != runtime.GOARCH {
 		cmd.Env = append(cmd.Env, fmt.Sprint("GOARCH=", goenv.goarch))
 	}
@@ -1057,16 +1451,39 @@ func (goenv *goenv) goDoForPkg(tg *target, op string, tags string,
 		dir = platinaGoesDir // legacy packages
 	}
 	dirPath := filepath.Join(*platinaPath, dir)
+	lock, err := lockDir(dirPath, "go-"+strings.Replace(dir, "/", "-", -1))
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if err = checkLockedTree(dirPath); err != nil {
+		return err
+	}
 	ver, err := shellCommandOutput("cd " + dirPath + " && git describe --tags")
 	if err != nil {
 		fmt.Printf("Error getting info for %s/%s: %s\n", dirPath, tg.name, err)
 		panic(err)
 	}
-	flag := "-X main.Version=" + ver
-	if len(ldflags) == 0 {
-		ldflags = flag
-	} else {
-		ldflags = ldflags + " " + flag
+	suffix, err := checkSourceTree(dirPath)
+	if err != nil {
+		return err
+	}
+	ver += suffix
+	gf := tg.buildGoflags()
+	xflags, err := gf.ldvarFlags(tg, dirPath)
+	if err != nil {
+		return err
+	}
+	for _, flag := range append([]string{gf.ldflags,
+		"-X main.Version=" + ver}, xflags...) {
+		if len(flag) == 0 {
+			continue
+		}
+		if len(ldflags) == 0 {
+			ldflags = flag
+		} else {
+			ldflags = ldflags + " " + flag
+		}
 	}
 	if len(tg.tags) > 0 {
 		if len(tags) > 0 {
@@ -1074,14 +1491,28 @@ func (goenv *goenv) goDoForPkg(tg *target, op string, tags string,
 		}
 		tags = tags + tg.tags
 	}
-	args := []string{op, "-o", tg.name}
+	args := []string{op, "-o", tg.output()}
 	if len(tags) > 0 {
 		args = append(args, "-tags", tags)
 	}
+	args = append(args, gf.args()...)
 	args = append(args, pkgArgs...)
 	args = append(args, "-ldflags", ldflags)
 	args = append(args, dirPath)
-	return goenv.goDoInDir(dir, args...)
+	if err = goenv.goDoInDir(tg, dir, args...); err != nil {
+		return err
+	}
+	if op != "build" {
+		return nil
+	}
+	bin := filepath.Join(dirPath, tg.output())
+	if err = goenv.recordBuildInfo(tg, dirPath, bin); err != nil {
+		return err
+	}
+	if err = goenv.vulncheckBuilt(tg, bin); err != nil {
+		return err
+	}
+	return goenv.checkBinarySize(tg, bin)
 }
 
 func (goenv *goenv) log(args ...string) {
@@ -1201,10 +1632,35 @@ func filterCommand(in io.Reader, out io.Writer, name string, args ...string) (cm
 	return cmd, cmd.Start()
 }
 
+// strippedBinary is a stripped copy of a goes binary, kept so that it is
+// stripped once for both checkBinarySize and its initramfs.
+type strippedBinary struct {
+	modTime time.Time
+	data    []byte
+}
+
+var (
+	strippedBinaries      = map[string]strippedBinary{}
+	strippedBinariesMutex sync.Mutex
+)
+
 func (goenv *goenv) stripBinary(in string) (out []byte, err error) {
+	fi, err := os.Stat(in)
+	if err == nil {
+		strippedBinariesMutex.Lock()
+		sb, found := strippedBinaries[in]
+		strippedBinariesMutex.Unlock()
+		if found && sb.modTime.Equal(fi.ModTime()) {
+			return sb.data, nil
+		}
+	}
 	outfile := in + ".strip.tmp"
 	cmdline := []string{"-o", outfile, in}
-	stripper := goenv.gnuPrefix + "strip"
+	prefix, err := goenv.crossCompile()
+	if err != nil {
+		return
+	}
+	stripper := prefix + "strip"
 	host.log(append([]string{stripper}, cmdline...)...)
 	if *nFlag {
 		return nil, nil
@@ -1219,6 +1675,11 @@ func (goenv *goenv) stripBinary(in string) (out []byte, err error) {
 		return
 	}
 	out, err = ioutil.ReadFile(outfile)
+	if err == nil && fi != nil {
+		strippedBinariesMutex.Lock()
+		strippedBinaries[in] = strippedBinary{fi.ModTime(), out}
+		strippedBinariesMutex.Unlock()
+	}
 	return
 }
 
@@ -1266,31 +1727,72 @@ func shellCommandRun(cmdline string) (err error) {
 	return
 }
 
-func findWorktree(repo string, machine string) (workdir string, gitdir string, err error) {
-	for _, dir := range []string{
-		filepath.Join(*platinaPath, repo),
-		filepath.Join(*platinaPath, "src", repo),
-		filepath.Join(*platinaPath, platinaSystemBuildSrcDir, repo),
-	} {
-		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
-			var err error
+// shellCommandTerminal runs cmdline on the terminal, e.g. for menuconfig.
+func shellCommandTerminal(cmdline string) error {
+	cmd := shellCommand(cmdline)
+	if cmd == nil {
+		return nil
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+// findGitdir returns the repository worktrees of repo are created from:
+// its local clone, or with -offline its mirror.
+func findGitdir(repo string) (gitdir string, err error) {
+	if *offlineFlag {
+		return offlineGitdir(repo)
+	}
+	return findSourceGitdir(repo)
+}
+
+// findSourceGitdir returns the absolute path of the source repository for
+// repo, which may be a bare mirror. A path set with -repo, the environment
+// or the configuration is used as is; otherwise the usual places under
+// -platinapath are searched.
+func findSourceGitdir(repo string) (gitdir string, err error) {
+	dirs, source := repoSearchPath(repo)
+	for _, dir := range dirs {
+		if isGitRepo(dir) {
 			gitdir, err = filepath.Abs(dir)
 			if err != nil {
-				return "", "", fmt.Errorf("Can't make %s absolute: %s",
+				return "", fmt.Errorf("Can't make %s absolute: %s",
 					dir, err)
 			}
-			break
+			return gitdir, nil
 		}
 	}
-	if len(gitdir) == 0 {
-		return "", "", fmt.Errorf("can't find gitdir for %s", repo)
+	return "", fmt.Errorf("can't find gitdir for %s%s; tried %s",
+		repo, source, strings.Join(dirs, ", "))
+}
+
+func findWorktree(repo string, machine string) (workdir string, gitdir string, err error) {
+	gitdir, err = findGitdir(repo)
+	if err != nil {
+		return "", "", err
 	}
 	workdir = filepath.Join(*worktreePath, machine, repo)
 	fmt.Printf("Workdir: %s\n", workdir)
 	return
 }
 
-func configWorktree(repo string, machine string, config string) (workdir string, err error) {
+// worktreeStampFile returns the configStamp file of the worktree workdir,
+// which is kept in its git directory so that it survives git clean.
+func worktreeStampFile(workdir string) (string, error) {
+	gitdir, err := shellCommandOutput("cd " + workdir +
+		" && git rev-parse --absolute-git-dir")
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", workdir, err)
+	}
+	return filepath.Join(gitdir, "goes-build-config.sha256"), nil
+}
+
+// configWorktree creates, checks out, patches and configures the worktree
+// tg is built in. The config command, which makes .config from the
+// defconfig file, is rerun whenever either changes. The worktree is locked
+// against other goes-build processes until the returned unlock is called.
+func configWorktree(tg *target, defconfig string, config string) (workdir string, unlock func(), err error) {
+	repo, machine := tg.worktree()
 	workdir, gitdir, err := findWorktree(repo, machine)
 	if err != nil {
 		return
@@ -1299,57 +1801,123 @@ func configWorktree(repo string, machine string, config string) (workdir string,
 	_, err = os.Stat(filepath.Join(workdir, ".git"))
 	fmt.Printf("configWorktree: os.Stat(%s) returned %s\n", workdir, err)
 	if err != nil {
-		if os.IsNotExist(err) {
-			worktreeMutex.Lock()
-			defer worktreeMutex.Unlock()
-			clone := ""
-			if *cloneFlag {
-				clone = " || git clone . $p"
-			}
-			if err := shellCommandRun("mkdir -p " + workdir +
-				" && cd " + workdir +
-				" && p=`pwd` " +
-				" && cd " + gitdir +
-				" && git worktree prune" +
-				" && git worktree add --detach $p" + clone); err != nil {
-				return "", err
-			}
-			reconfig = true
-		} else {
-			return "", err
+		if !os.IsNotExist(err) {
+			return "", nil, err
+		}
+		if reconfig, err = addWorktree(gitdir, workdir); err != nil {
+			return "", nil, err
 		}
 	}
-	if *branchFlag != "" {
-		if err := shellCommandRun("cd " + workdir +
-			" && git checkout --detach " + *branchFlag); err != nil {
-			return "", err
+	lock, err := lockDir(workdir, "worktree")
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		if err != nil {
+			lock.unlock()
 		}
+	}()
+	base, err := worktreeBase(repo, machine, workdir)
+	if err != nil {
+		return "", nil, err
+	}
+	series, err := loadPatchSeries(tg.patchDir())
+	if err != nil {
+		return "", nil, err
+	}
+	if moved, err := checkoutWorktree(workdir, base, series); err != nil {
+		return "", nil, err
+	} else if moved {
 		reconfig = true
 	}
-	_, err = os.Stat(filepath.Join(workdir, ".config"))
-	if reconfig || os.IsNotExist(err) {
-		if err := shellCommandRun("cd " + workdir +
-			" && " + config); err != nil {
-			return "", err
+	modules, err := updateSubmodules(repo, workdir)
+	if err != nil {
+		return "", nil, err
+	}
+	stamp := ""
+	if !*nFlag {
+		if stamp, err = worktreeStampFile(workdir); err != nil {
+			return "", nil, err
 		}
 	}
-	return workdir, nil
+	if err = configure(machine+"/"+repo, workdir, workdir, defconfig,
+		config, stamp, reconfig); err != nil {
+		return "", nil, err
+	}
+	if _, err = checkSourceTree(workdir); err != nil {
+		return "", nil, err
+	}
+	commit, err := shellCommandOutput("cd " + workdir +
+		" && git rev-parse HEAD")
+	if err != nil {
+		return "", nil, err
+	}
+	manifest.setSource(machine+"/"+repo, commit)
+	for path, commit := range modules {
+		manifest.setSource(machine+"/"+repo+"/"+path, commit)
+	}
+	if series != nil {
+		manifest.setPatches(machine+"/"+repo, series.patches)
+	}
+	return workdir, lock.unlock, nil
+}
+
+// addWorktree adds a detached worktree of gitdir at workdir unless another
+// goes-build did so while this one waited for the repository lock.
+func addWorktree(gitdir, workdir string) (added bool, err error) {
+	lock, err := lockDir(gitdir, "worktrees")
+	if err != nil {
+		return false, err
+	}
+	defer lock.unlock()
+	if _, err = os.Stat(filepath.Join(workdir, ".git")); err == nil {
+		return false, nil
+	}
+	clone := ""
+	if *cloneFlag {
+		clone = " || git clone . $p"
+	}
+	if err = shellCommandRun("mkdir -p " + workdir +
+		" && cd " + workdir +
+		" && p=`pwd` " +
+		" && cd " + gitdir +
+		" && git worktree prune" +
+		" && git worktree add --detach $p" + clone); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// bootConfigCommand returns the command making the .config of the boot
+// loader target tg from its defconfig.
+func (goenv *goenv) bootConfigCommand(tg *target) string {
+	if goenv.boot == "coreboot" {
+		return "MAKEINFO=missing make crossgcc-i386 && make " + tg.config
+	}
+	return "make " + tg.config
 }
 
-func (goenv *goenv) makeboot(out string, configCommand string) (err error) {
-	machine := strings.TrimPrefix(out, goenv.boot+"-")
-	dir, err := configWorktree(goenv.boot, machine, configCommand)
+func (goenv *goenv) makeboot(tg *target) (err error) {
+	prefix, err := goenv.crossCompile()
 	if err != nil {
 		return
 	}
+	dir, unlock, err := configWorktree(tg, "configs/"+tg.config,
+		goenv.bootConfigCommand(tg))
+	if err != nil {
+		return
+	}
+	defer unlock()
 	cmdline := "make -C " + dir +
 		" ARCH=" + goenv.kernelArch +
-		" CROSS_COMPILE=" + goenv.gnuPrefix
-	if !*zFlag { // quiet "Skipping submodule and Created CBFS" messages
-		cmdline += " 2>/dev/null"
+		" CROSS_COMPILE=" + prefix
+	if goenv.boot == "coreboot" {
+		// configWorktree has checked out the submodules; keep
+		// coreboot's make from updating them from the network.
+		cmdline += " UPDATED_SUBMODULES=1"
 	}
 	if err := shellCommandRun(cmdline); err != nil {
-		return err
+		return fmt.Errorf("make in %s: %s", dir, err)
 	}
 	return
 }
@@ -1359,6 +1927,10 @@ func getPackageVersions(dir string) (id, pkgver string, err error) {
 	if err != nil {
 		return
 	}
+	suffix, err := checkSourceTree(dir)
+	if err != nil {
+		return
+	}
 	ver = strings.TrimLeft(ver, "v")
 	f := strings.Split(ver, "-")
 	if len(f) == 1 {
@@ -1373,63 +1945,94 @@ func getPackageVersions(dir string) (id, pkgver string, err error) {
 			pkgver = id + "-" + strings.Join(f[2:], "-")
 		}
 	}
+	pkgver += suffix
 	return
 }
 
 func (goenv *goenv) makeLinux(tg *target) (err error) {
 	machine := strings.TrimSuffix(tg.name, ".vmlinuz")
-	configCommand := "cp " + goenv.kernelConfigPath + "/" + tg.config +
-		" .config" +
-		" && make oldconfig ARCH=" + goenv.kernelArch
-
-	dir, err := configWorktree("linux", machine, configCommand)
+	prefix, err := goenv.crossCompile()
+	if err != nil {
+		return
+	}
+	dir, out, unlock, err := goenv.configKernel(tg,
+		goenv.kernelConfigPath+"/"+tg.config)
 	if err != nil {
 		return
 	}
+	defer unlock()
 	id, pkgver, err := getPackageVersions(dir)
-	if err := shellCommandRun("make -C " + dir +
+	makeCmd := "make -C " + dir +
+		" O=" + out +
 		" -j " + strconv.Itoa(runtime.NumCPU()*2) +
 		" ARCH=" + goenv.kernelArch +
-		" CROSS_COMPILE=" + goenv.gnuPrefix +
+		" CROSS_COMPILE=" + prefix +
 		" KDEB_PKGVERSION=" + pkgver +
-		" KERNELRELEASE=" + id + "-" + machine + " " +
-		goenv.kernelMakeTarget); err != nil {
+		" KERNELRELEASE=" + id + "-" + machine
+	if tg.hasOverlays() {
+		// DTBs need their symbols for overlays to apply
+		makeCmd += " DTC_FLAGS=-@"
+	}
+	targets := goenv.kernelMakeTarget
+	if kernelHasModules(out) {
+		targets += " modules"
+	}
+	if err := shellCommandRun(makeCmd + " " + targets); err != nil {
 		return err
 	}
-	cmdline := "cp " + dir + "/" + goenv.kernelPath + " " + tg.name
+	if err = installKernelModules(makeCmd, out, machine); err != nil {
+		return err
+	}
+	cmdline := "cp " + out + "/" + goenv.kernelPath + " " + tg.name
 	if err := shellCommandRun(cmdline); err != nil {
 		return err
 	}
-	return
+	return checkFileSize(tg, tg.name)
 }
 
 func (goenv *goenv) makeLinuxDeb(tg *target) (err error) {
 	machine := strings.TrimSuffix(tg.name, ".deb")
-	dir, _, err := findWorktree("linux", machine)
+	prefix, err := goenv.crossCompile()
+	if err != nil {
+		return
+	}
+	dir, err := kernelSource(machine)
+	if err != nil {
+		return
+	}
+	out, err := kernelBuildDir(machine)
+	if err != nil {
+		return
+	}
+	lock, err := lockDir(out, "kernel-"+machine)
 	if err != nil {
 		return
 	}
+	defer lock.unlock()
 	id, pkgver, err := getPackageVersions(dir)
 	pkgarch := pkgver + "_" + goenv.goarch
 	pkgdeb := pkgarch + ".deb"
 	idmach := id + "-" + machine
 	iddeb := idmach + "_" + pkgdeb
 	iddbgdeb := idmach + "-dbg_" + pkgdeb
+	// bindeb-pkg writes the packages to the parent of the build
+	// directory.
 	cmd := "make -C " + dir +
+		" O=" + out +
 		" -j " + strconv.Itoa(runtime.NumCPU()*2) +
 		" ARCH=" + goenv.kernelArch +
-		" CROSS_COMPILE=" + goenv.gnuPrefix +
+		" CROSS_COMPILE=" + prefix +
 		" KDEB_PKGVERSION=" + pkgver +
 		" KERNELRELEASE=" + idmach +
 		" bindeb-pkg &&" +
 		" cp " +
-		filepath.Join(dir, "..", "linux-headers-"+iddeb) +
+		filepath.Join(out, "..", "linux-headers-"+iddeb) +
 		" " +
-		filepath.Join(dir, "..", "linux-image-"+iddeb) +
+		filepath.Join(out, "..", "linux-image-"+iddeb) +
 		" " +
-		filepath.Join(dir, "..", "linux-image-"+iddbgdeb) +
+		filepath.Join(out, "..", "linux-image-"+iddbgdeb) +
 		" " +
-		filepath.Join(dir, "..", "linux-libc-dev_"+pkgdeb) +
+		filepath.Join(out, "..", "linux-libc-dev_"+pkgdeb) +
 		" ."
 	if err := shellCommandRun(cmd); err != nil {
 		return err
@@ -1475,7 +2078,7 @@ func (goenv *goenv) makeDebianControl(tg *target) (err error) {
 			} else {
 				machine = ps[len(ps)-3] + "-" + ps[len(ps)-2]
 			}
-			dir, _, err := findWorktree("linux", machine)
+			dir, err := kernelSource(machine)
 			if err != nil {
 				panic(err)
 			}
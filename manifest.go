@@ -0,0 +1,114 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// buildManifest records what went into a build. It is written as JSON to
+// the -manifest file once all requested targets are made.
+type buildManifest struct {
+	mutex      sync.Mutex
+	Started    time.Time
+	Finished   time.Time
+	Targets    []string
+	Variant    string                    `json:",omitempty"`
+	Lock       string                    `json:",omitempty"`
+	Toolchains map[string]*toolchainInfo `json:",omitempty"`
+	GoVersions map[string]string         `json:",omitempty"`
+	Sources    map[string]string         `json:",omitempty"`
+	Patches    map[string][]patchInfo    `json:",omitempty"`
+	Fragments  map[string][]string       `json:",omitempty"`
+	Binaries   map[string]*buildInfo     `json:",omitempty"`
+}
+
+// toolchainInfo describes the cross compiler used for a GOARCH.
+type toolchainInfo struct {
+	Prefix  string
+	Version string
+}
+
+var manifest = &buildManifest{}
+
+func (m *buildManifest) setToolchain(goarch string, ti *toolchainInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Toolchains == nil {
+		m.Toolchains = map[string]*toolchainInfo{}
+	}
+	m.Toolchains[goarch] = ti
+}
+
+func (m *buildManifest) setGoVersion(name, version string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.GoVersions == nil {
+		m.GoVersions = map[string]string{}
+	}
+	m.GoVersions[name] = version
+}
+
+func (m *buildManifest) goVersion(name string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.GoVersions[name]
+}
+
+// setSource records the commit the worktree MACHINE/REPO was built at.
+func (m *buildManifest) setSource(name, commit string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Sources == nil {
+		m.Sources = map[string]string{}
+	}
+	m.Sources[name] = commit
+}
+
+// setPatches records the patch series applied to the worktree
+// MACHINE/REPO.
+func (m *buildManifest) setPatches(name string, patches []patchInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Patches == nil {
+		m.Patches = map[string][]patchInfo{}
+	}
+	m.Patches[name] = patches
+}
+
+// setFragments records the config fragments merged into the kernel built
+// in MACHINE/linux.
+func (m *buildManifest) setFragments(name string, fragments []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Fragments == nil {
+		m.Fragments = map[string][]string{}
+	}
+	m.Fragments[name] = fragments
+}
+
+func (m *buildManifest) setBuildInfo(name string, bi *buildInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.Binaries == nil {
+		m.Binaries = map[string]*buildInfo{}
+	}
+	m.Binaries[name] = bi
+}
+
+func (m *buildManifest) write(fn string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Finished = time.Now()
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	host.log("{manifest}write", fn)
+	return ioutil.WriteFile(fn, append(b, '\n'), 0644)
+}
@@ -0,0 +1,167 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// mirrorDir returns the bare mirror of repo in -mirrors.
+func mirrorDir(repo string) string {
+	return filepath.Join(*mirrorsFlag, repo+".git")
+}
+
+// submoduleMirror returns the bare mirror of the submodule name of repo,
+// e.g. mirrors/coreboot/3rdparty/blobs.git.
+func submoduleMirror(repo, name string) string {
+	return filepath.Join(*mirrorsFlag, repo, name+".git")
+}
+
+// offlineGitdir returns the mirror of repo, which with -offline is the
+// only place worktrees are created from.
+func offlineGitdir(repo string) (string, error) {
+	dir := mirrorDir(repo)
+	if !isBareRepo(dir) {
+		return "", fmt.Errorf("no mirror of %s in %s; "+
+			"run goes-build mirror %s first", repo, *mirrorsFlag, repo)
+	}
+	return filepath.Abs(dir)
+}
+
+// mirrorRepos creates or refreshes the bare mirrors of repos, by default
+// the worktree repositories, and of their submodules, from the local
+// clones findGitdir would otherwise use.
+func mirrorRepos(args []string) error {
+	if len(args) == 0 {
+		args = worktreeRepos
+	}
+	if err := os.MkdirAll(*mirrorsFlag, 0755); err != nil {
+		return err
+	}
+	lock, err := lockFile(filepath.Join(*mirrorsFlag,
+		"goes-build-mirror.lock"))
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	for _, repo := range args {
+		src, err := findSourceGitdir(repo)
+		if err != nil {
+			return err
+		}
+		dst := mirrorDir(repo)
+		if err = mirrorRepo(repo, src, dst); err != nil {
+			return err
+		}
+		modules, err := submodules(src)
+		if err != nil {
+			return fmt.Errorf("%s: %s", src, err)
+		}
+		names := []string{}
+		for name := range modules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			msrc := submoduleSource(src, name, modules[name])
+			if msrc == "" {
+				fmt.Printf("# %s: submodule %s isn't checked out "+
+					"in %s; not mirrored\n", repo, name, src)
+				continue
+			}
+			if err = mirrorRepo(repo+"/"+name, msrc,
+				submoduleMirror(repo, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mirrorRepo clones src to the bare mirror dst, or fetches every ref of
+// src into it, pruning those src no longer has.
+func mirrorRepo(name, src, dst string) error {
+	abs, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+	if abs == src {
+		return fmt.Errorf("%s: %s is its own mirror", name, src)
+	}
+	action := "updated"
+	if isBareRepo(dst) {
+		err = shellCommandRun("cd " + dst +
+			" && git remote set-url origin " + src +
+			" && git fetch -q --prune origin")
+	} else {
+		action = "created"
+		err = shellCommandRun("mkdir -p " + filepath.Dir(dst) +
+			" && git clone -q --mirror " + src + " " + dst)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: can't mirror %s to %s: %s", name, src,
+			dst, err)
+	}
+	fmt.Printf("%s\t%s\t%s\n", name, action, dst)
+	return nil
+}
+
+// submodules returns the paths of the submodules in the .gitmodules of
+// the HEAD commit of dir, by name.
+func submodules(dir string) (map[string]string, error) {
+	if shellCommandRun("cd "+dir+
+		" && git cat-file -e HEAD:.gitmodules 2>/dev/null") != nil {
+		return nil, nil
+	}
+	out, err := shellCommandOutput("cd " + dir +
+		" && git config --blob HEAD:.gitmodules" +
+		" --get-regexp '^submodule\\..*\\.path$'")
+	if err != nil {
+		return nil, err
+	}
+	return parseSubmodules(out), nil
+}
+
+// parseSubmodules parses the submodule.NAME.path PATH lines of
+// git config --get-regexp.
+func parseSubmodules(out string) map[string]string {
+	modules := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) != 2 || !strings.HasPrefix(f[0], "submodule.") ||
+			!strings.HasSuffix(f[0], ".path") {
+			continue
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(f[0],
+			"submodule."), ".path")
+		modules[name] = f[1]
+	}
+	return modules
+}
+
+// submoduleSource returns the git directory of the submodule name checked
+// out at path in the clone dir, or the empty string if it isn't.
+func submoduleSource(dir, name, path string) string {
+	gitpath, err := shellCommandOutput("cd " + dir +
+		" && git rev-parse --git-path modules/" + name)
+	if err == nil && gitpath != "" {
+		if !filepath.IsAbs(gitpath) {
+			gitpath = filepath.Join(dir, gitpath)
+		}
+		if isBareRepo(gitpath) {
+			return gitpath
+		}
+	}
+	// submodules cloned before git 1.7.8 keep their .git directory
+	gitpath = filepath.Join(dir, path, ".git")
+	if fi, err := os.Stat(gitpath); err == nil && fi.IsDir() {
+		return gitpath
+	}
+	return ""
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSubmodules(t *testing.T) {
+	out := "submodule.3rdparty/blobs.path 3rdparty/blobs\n" +
+		"submodule.vboot.path 3rdparty/vboot\n" +
+		"submodule.x.url ../x.git\n"
+	m := parseSubmodules(out)
+	if len(m) != 2 || m["3rdparty/blobs"] != "3rdparty/blobs" ||
+		m["vboot"] != "3rdparty/vboot" {
+		t.Errorf("parseSubmodules = %v", m)
+	}
+}
+
+func TestMirrorRepos(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goes-build-mirror")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p, m string) {
+		*platinaPath, *mirrorsFlag = p, m
+	}(*platinaPath, *mirrorsFlag)
+	*platinaPath = dir
+	*mirrorsFlag = filepath.Join(dir, "mirrors")
+	src := filepath.Join(dir, "linux")
+	commit := func() string {
+		if err := shellCommandRun("cd " + src +
+			" && git -c user.name=t -c user.email=t@localhost" +
+			" commit -q --allow-empty -m test"); err != nil {
+			t.Fatal(err)
+		}
+		head, err := shellCommandOutput("cd " + src +
+			" && git rev-parse HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return head
+	}
+	if err = shellCommandRun("git init -q " + src); err != nil {
+		t.Fatal(err)
+	}
+	commit()
+
+	if _, err = offlineGitdir("linux"); err == nil {
+		t.Error("offlineGitdir found a mirror before mirrorRepos")
+	}
+	for i := 0; i < 2; i++ {
+		head := commit()
+		if err = mirrorRepos([]string{"linux"}); err != nil {
+			t.Fatal(err)
+		}
+		gitdir, err := offlineGitdir("linux")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := filepath.Abs(mirrorDir("linux")); gitdir != want {
+			t.Errorf("offlineGitdir = %s, want %s", gitdir, want)
+		}
+		mirrored, err := shellCommandOutput("cd " + gitdir +
+			" && git rev-parse HEAD")
+		if err != nil || mirrored != head {
+			t.Errorf("mirror %d at %s (%v), want %s", i, mirrored,
+				err, head)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// buildInfo is the module information embedded in a goes binary, as
+// reported by go version -m.
+type buildInfo struct {
+	GoVersion string
+	Path      string
+	Main      debug.Module
+	Deps      []*debug.Module `json:",omitempty"`
+	Settings  []buildSetting  `json:",omitempty"`
+	text      string          // go version -m output
+}
+
+// buildSetting is a build setting of a goes binary, such as -tags or
+// CGO_ENABLED, like debug.BuildSetting of Go 1.18.
+type buildSetting struct {
+	Key, Value string
+}
+
+// readBuildInfo returns the build information of the goes binary bin of
+// tg with go version -m of the toolchain tg is built with, as goes-build
+// itself is built with a go older than debug/buildinfo.
+func (goenv *goenv) readBuildInfo(tg *target, bin string) (*buildInfo, error) {
+	tc, err := goenv.goToolchain(tg)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(tc.path, "version", "-m", bin)
+	cmd.Env = append(os.Environ(), tc.env...)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: go version -m: %s", bin, err)
+	}
+	bi := parseBuildInfo(string(out))
+	if bi.Path == "" {
+		return nil, fmt.Errorf("%s: no module information", bin)
+	}
+	return bi, nil
+}
+
+// parseBuildInfo parses the output of go version -m: a BINARY: GOVERSION
+// line, then a line per path, mod, dep, => (replacing the module before)
+// and build setting, indented by a tab.
+func parseBuildInfo(out string) *buildInfo {
+	bi := &buildInfo{text: out}
+	var last *debug.Module
+	for i, line := range strings.Split(out, "\n") {
+		if i == 0 {
+			if f := strings.Fields(line); len(f) > 0 {
+				bi.GoVersion = f[len(f)-1]
+			}
+			continue
+		}
+		f := strings.Split(strings.TrimPrefix(line, "\t"), "\t")
+		for len(f) < 4 {
+			f = append(f, "")
+		}
+		m := &debug.Module{Path: f[1], Version: f[2], Sum: f[3]}
+		switch f[0] {
+		case "path":
+			bi.Path = f[1]
+		case "mod":
+			bi.Main = *m
+			last = &bi.Main
+		case "dep":
+			bi.Deps = append(bi.Deps, m)
+			last = m
+		case "=>":
+			if last != nil {
+				last.Replace = m
+			}
+		case "build":
+			if s, ok := parseBuildSetting(f[1]); ok {
+				bi.Settings = append(bi.Settings, s)
+			}
+		}
+	}
+	return bi
+}
+
+// parseBuildSetting parses the KEY=VALUE of a build line, where VALUE is
+// quoted if it has spaces or quotes.
+func parseBuildSetting(kv string) (buildSetting, bool) {
+	i := strings.Index(kv, "=")
+	if i < 0 {
+		return buildSetting{}, false
+	}
+	s := buildSetting{Key: kv[:i], Value: kv[i+1:]}
+	if strings.HasPrefix(s.Value, `"`) {
+		v, err := strconv.Unquote(s.Value)
+		if err != nil {
+			return buildSetting{}, false
+		}
+		s.Value = v
+	}
+	return s, true
+}
+
+// recordBuildInfo reads the module and build information embedded in the
+// goes binary bin of tg, built in dir, into the build manifest and writes
+// it to <output>.modules.txt. In -release mode a binary linked with a
+// replace directive pointing outside -platinapath is refused.
+func (goenv *goenv) recordBuildInfo(tg *target, dir, bin string) error {
+	if *nFlag {
+		return nil
+	}
+	bi, err := goenv.readBuildInfo(tg, bin)
+	if err != nil {
+		return err
+	}
+	manifest.setBuildInfo(tg.output(), bi)
+	report := tg.output() + ".modules.txt"
+	host.log("{modules}write", report)
+	if err = ioutil.WriteFile(report, []byte(bi.text), 0644); err != nil {
+		return err
+	}
+	if !*releaseFlag {
+		return nil
+	}
+	root, err := filepath.Abs(*platinaPath)
+	if err != nil {
+		return err
+	}
+	moddir := moduleRoot(dir)
+	for _, m := range append([]*debug.Module{&bi.Main}, bi.Deps...) {
+		r := m.Replace
+		if r == nil || r.Version != "" {
+			continue // not a directory replacement
+		}
+		path := r.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(moddir, path)
+		}
+		if path, err = filepath.Abs(path); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s: %s is replaced by %s outside %s; "+
+				"not building a release", tg.output(), m.Path,
+				r.Path, *platinaPath)
+		}
+	}
+	return nil
+}
+
+// moduleRoot returns the directory containing the go.mod governing dir,
+// or dir itself if there is none.
+func moduleRoot(dir string) string {
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
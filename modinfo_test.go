@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"runtime/debug"
+	"testing"
+)
+
+func TestParseBuildInfo(t *testing.T) {
+	out := "goes-platina-mk1: go1.14.15\n" +
+		"\tpath\tgithub.com/platinasystems/goes/main/goes-platina-mk1\n" +
+		"\tmod\tgithub.com/platinasystems/goes\t(devel)\t\n" +
+		"\tdep\tgithub.com/platinasystems/atsock\tv1.1.0\th1:abc=\n" +
+		"\tdep\tgithub.com/platinasystems/fe1\tv1.2.3\th1:def=\n" +
+		"\t=>\t../fe1\t\t\n" +
+		"\tdep\tgolang.org/x/sys\tv0.0.1\th1:ghi=\n" +
+		"\t=>\tgolang.org/x/sys\tv0.0.2\th1:jkl=\n" +
+		"\tbuild\t-compiler=gc\n" +
+		"\tbuild\t-ldflags=\"-X main.Version=v1.0 -s\"\n" +
+		"\tbuild\tCGO_ENABLED=1\n"
+	bi := parseBuildInfo(out)
+	want := &buildInfo{
+		GoVersion: "go1.14.15",
+		Path:      "github.com/platinasystems/goes/main/goes-platina-mk1",
+		Main: debug.Module{
+			Path:    "github.com/platinasystems/goes",
+			Version: "(devel)",
+		},
+		Deps: []*debug.Module{
+			{
+				Path:    "github.com/platinasystems/atsock",
+				Version: "v1.1.0",
+				Sum:     "h1:abc=",
+			},
+			{
+				Path:    "github.com/platinasystems/fe1",
+				Version: "v1.2.3",
+				Sum:     "h1:def=",
+				Replace: &debug.Module{Path: "../fe1"},
+			},
+			{
+				Path:    "golang.org/x/sys",
+				Version: "v0.0.1",
+				Sum:     "h1:ghi=",
+				Replace: &debug.Module{
+					Path:    "golang.org/x/sys",
+					Version: "v0.0.2",
+					Sum:     "h1:jkl=",
+				},
+			},
+		},
+		Settings: []buildSetting{
+			{"-compiler", "gc"},
+			{"-ldflags", "-X main.Version=v1.0 -s"},
+			{"CGO_ENABLED", "1"},
+		},
+		text: out,
+	}
+	if !reflect.DeepEqual(bi, want) {
+		t.Errorf("parseBuildInfo = %+v, want %+v", bi, want)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/platinasystems/go-cpio"
+)
+
+// addKernelDependencies makes the initramfs targets that include the
+// modules of their kernel, with -modules, depend on it.
+func addKernelDependencies() {
+	if !*modulesFlag {
+		return
+	}
+	for _, tg := range allTargets {
+		if tg.kernel != nil {
+			tg.dependencies = append(tg.dependencies, tg.kernel)
+		}
+	}
+}
+
+// kernelModulesDir returns the directory the modules of the kernel of
+// machine are staged in by modules_install, as lib/modules/RELEASE.
+func kernelModulesDir(machine string) (string, error) {
+	out, err := kernelBuildDir(machine)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(out, "modules_install"), nil
+}
+
+// kernelHasModules reports whether the .config in out enables loadable
+// modules.
+func kernelHasModules(out string) bool {
+	if *nFlag {
+		return false
+	}
+	kc, err := readKconfig(filepath.Join(out, ".config"))
+	return err == nil && kc.values["CONFIG_MODULES"] == "y"
+}
+
+// installKernelModules stages the stripped modules of the kernel of
+// machine, built in out, and their modules.dep. The stage is emptied
+// first so that it never holds the modules of an older release.
+func installKernelModules(makeCmd, out, machine string) error {
+	stage, err := kernelModulesDir(machine)
+	if err != nil {
+		return err
+	}
+	if err = shellCommandRun("rm -rf " + stage); err != nil {
+		return err
+	}
+	if !kernelHasModules(out) {
+		return nil
+	}
+	return shellCommandRun(makeCmd +
+		" INSTALL_MOD_PATH=" + stage +
+		" INSTALL_MOD_STRIP=1" +
+		" modules_install")
+}
+
+// addKernelModules adds the staged lib/modules tree of tg's kernel to the
+// archive, after checking that it and every module are of the release of
+// the kernel last built. A kernel without loadable modules is skipped.
+func addKernelModules(w *cpio.Writer, tg *target) error {
+	_, machine := tg.kernel.worktree()
+	out, err := kernelBuildDir(machine)
+	if err != nil {
+		return err
+	}
+	lock, err := lockDir(out, "kernel-"+machine)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	if !kernelHasModules(out) {
+		fmt.Printf("# %s: %s is built without modules; none added\n",
+			tg.name, tg.kernel.name)
+		return nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(out,
+		"include/config/kernel.release"))
+	if err != nil {
+		return err
+	}
+	release := strings.TrimSpace(string(b))
+	stage, err := kernelModulesDir(machine)
+	if err != nil {
+		return err
+	}
+	root := filepath.Join(stage, "lib/modules")
+	fis, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: no modules staged for %s", root,
+			tg.kernel.name)
+	} else if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Name() != release {
+			return fmt.Errorf("%s has modules of kernel %s, "+
+				"but %s is %s", root, fi.Name(), tg.kernel.name,
+				release)
+		}
+	}
+	dir := filepath.Join(root, release)
+	if _, err = os.Stat(filepath.Join(dir, "modules.dep")); err != nil {
+		return fmt.Errorf("%s: no modules.dep; is depmod installed?",
+			dir)
+	}
+	for _, name := range []string{"lib", "lib/modules"} {
+		if err = mkdirCpio(w, name, 0755); err != nil {
+			return err
+		}
+	}
+	return filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.Join("lib/modules", rel)
+		switch {
+		case fi.IsDir():
+			return mkdirCpio(w, name, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			// build and source link to this host's build tree
+			return nil
+		case strings.HasSuffix(path, ".ko"):
+			vermagic, err := moduleVermagic(path)
+			if err != nil {
+				return err
+			}
+			if vermagic != release {
+				return fmt.Errorf("%s is for kernel %s, not %s",
+					path, vermagic, release)
+			}
+		}
+		return mkfileFromHostCpio(w, name, fi.Mode().Perm(), path)
+	})
+}
+
+// moduleVermagic returns the kernel release the module fn was built for.
+func moduleVermagic(fn string) (string, error) {
+	f, err := elf.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sec := f.Section(".modinfo")
+	if sec == nil {
+		return "", fmt.Errorf("%s: no .modinfo section", fn)
+	}
+	modinfo, err := sec.Data()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", fn, err)
+	}
+	vermagic := parseVermagic(modinfo)
+	if vermagic == "" {
+		return "", fmt.Errorf("%s: no vermagic", fn)
+	}
+	return vermagic, nil
+}
+
+// parseVermagic returns the release in the vermagic of a module's
+// .modinfo, e.g. 5.4.0-platina-mk1 of "vermagic=5.4.0-platina-mk1 SMP
+// mod_unload".
+func parseVermagic(modinfo []byte) string {
+	for _, s := range bytes.Split(modinfo, []byte{0}) {
+		if bytes.HasPrefix(s, []byte("vermagic=")) {
+			if f := strings.Fields(string(s[len("vermagic="):])); len(f) > 0 {
+				return f[0]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestParseVermagic(t *testing.T) {
+	for _, test := range []struct {
+		modinfo string
+		want    string
+	}{
+		{"license=GPL\x00vermagic=5.4.0-platina-mk1 SMP mod_unload \x00",
+			"5.4.0-platina-mk1"},
+		{"vermagic=4.19.0-bmc ARMv7 p2v8 \x00name=x\x00", "4.19.0-bmc"},
+		{"license=GPL\x00", ""},
+		{"vermagic=\x00", ""},
+	} {
+		if got := parseVermagic([]byte(test.modinfo)); got != test.want {
+			t.Errorf("parseVermagic(%q) = %q, want %q", test.modinfo,
+				got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// patchesDir holds the default patch series of worktrees, in
+// patchesDir/MACHINE/REPO.
+const patchesDir = "patches"
+
+// patchSeries is a quilt style directory of patches listed, in the order
+// they apply, in its series file.
+type patchSeries struct {
+	dir     string
+	patches []patchInfo
+	hash    string
+}
+
+// patchInfo identifies a patch applied to a worktree in the manifest.
+type patchInfo struct {
+	Name    string
+	SHA256  string
+	Options string `json:",omitempty"` // -pN from the series file
+}
+
+// patchOptionRE matches the quilt series options passed on to git.
+var patchOptionRE = regexp.MustCompile(`^-p[0-9]+$`)
+
+// patchStamp records the series applied to a worktree on top of Base,
+// giving Head. It is kept in the worktree's git directory.
+type patchStamp struct {
+	Base   string
+	Series string
+	Head   string
+}
+
+// patchDir returns the patch series directory of tg's worktree: that of
+// the configuration, or patches/MACHINE/REPO if it has a series file.
+func (tg *target) patchDir() string {
+	if dir, found := cfg.Patches[tg.name]; found {
+		return dir
+	}
+	repo, machine := tg.worktree()
+	dir := filepath.Join(patchesDir, machine, repo)
+	if _, err := os.Stat(filepath.Join(dir, "series")); err == nil {
+		return dir
+	}
+	return ""
+}
+
+// loadPatchSeries reads the series file of dir, returning nil if dir is
+// empty.
+func loadPatchSeries(dir string) (*patchSeries, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "series"))
+	if err != nil {
+		return nil, err
+	}
+	ps := &patchSeries{dir: dir}
+	h := sha256.New()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		// quilt allows options such as -p1 after the name
+		f := strings.Fields(scanner.Text())
+		if len(f) == 0 || strings.HasPrefix(f[0], "#") {
+			continue
+		}
+		opts := f[1:]
+		for i, opt := range opts {
+			if strings.HasPrefix(opt, "#") {
+				opts = opts[:i]
+				break
+			}
+		}
+		if len(opts) > 1 ||
+			len(opts) == 1 && !patchOptionRE.MatchString(opts[0]) {
+			return nil, fmt.Errorf("%s: %s: unsupported options %s; "+
+				"use -pN", dir, f[0], strings.Join(opts, " "))
+		}
+		p, err := ioutil.ReadFile(filepath.Join(dir, f[0]))
+		if err != nil {
+			return nil, err
+		}
+		sum := fmt.Sprintf("%x", sha256.Sum256(p))
+		pi := patchInfo{Name: f[0], SHA256: sum,
+			Options: strings.Join(opts, " ")}
+		fmt.Fprintf(h, "%s %s\n", sum,
+			strings.Join(append([]string{f[0]}, opts...), " "))
+		ps.patches = append(ps.patches, pi)
+	}
+	if len(ps.patches) == 0 {
+		return nil, fmt.Errorf("%s: empty series", dir)
+	}
+	ps.hash = fmt.Sprintf("%x", h.Sum(nil))
+	return ps, nil
+}
+
+func patchStampFile(workdir string) (string, error) {
+	gitdir, err := shellCommandOutput("cd " + workdir +
+		" && git rev-parse --absolute-git-dir")
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", workdir, err)
+	}
+	return filepath.Join(gitdir, "goes-build-patches.json"), nil
+}
+
+// readPatchStamp returns the series applied to the worktree, or nil if
+// none is or HEAD has since moved.
+func readPatchStamp(workdir string) *patchStamp {
+	fn, err := patchStampFile(workdir)
+	if err != nil {
+		return nil
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil
+	}
+	st := &patchStamp{}
+	if json.Unmarshal(b, st) != nil {
+		return nil
+	}
+	head, err := shellCommandOutput("cd " + workdir +
+		" && git rev-parse HEAD")
+	if err != nil || head != st.Head {
+		return nil
+	}
+	return st
+}
+
+// checkoutWorktree checks out the worktree detached at base, or at its
+// current, unpatched HEAD if base is empty, and applies the patch series
+// ps on top. It does nothing if the same series is already applied to the
+// same base and reports whether HEAD moved.
+func checkoutWorktree(workdir, base string, ps *patchSeries) (moved bool, err error) {
+	if *nFlag {
+		return false, nil
+	}
+	head, err := shellCommandOutput("cd " + workdir +
+		" && git rev-parse HEAD")
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", workdir, err)
+	}
+	st := readPatchStamp(workdir)
+	if base == "" {
+		base = head
+		if st != nil {
+			base = st.Base
+		}
+	}
+	if ps == nil && head == base {
+		return false, nil
+	}
+	if ps != nil && st != nil && st.Base == base && st.Series == ps.hash {
+		return false, nil
+	}
+	if err = shellCommandRun("cd " + workdir +
+		" && git checkout -q --detach " + base); err != nil {
+		return false, fmt.Errorf("%s: can't check out %s", workdir, base)
+	}
+	fn, err := patchStampFile(workdir)
+	if err != nil {
+		return false, err
+	}
+	if ps == nil {
+		os.Remove(fn)
+		return true, nil
+	}
+	for _, p := range ps.patches {
+		if err = applyPatch(workdir, filepath.Join(ps.dir, p.Name),
+			p.Name, p.Options); err != nil {
+			shellCommandRun("cd " + workdir +
+				" && git am --abort 2>/dev/null" +
+				"; git checkout -q -f --detach " + base)
+			return false, err
+		}
+	}
+	head, err = shellCommandOutput("cd " + workdir +
+		" && git rev-parse HEAD")
+	if err != nil {
+		return false, err
+	}
+	fmt.Printf("# %s: applied %d patches from %s\n", workdir,
+		len(ps.patches), ps.dir)
+	b, err := json.MarshalIndent(&patchStamp{base, ps.hash, head}, "",
+		"\t")
+	if err != nil {
+		return false, err
+	}
+	return true, ioutil.WriteFile(fn, append(b, '\n'), 0644)
+}
+
+// applyPatch commits the patch fn to the worktree with git am if it is
+// in mailbox format, e.g. from git format-patch, otherwise with git apply,
+// with the -pN option the series gives it.
+func applyPatch(workdir, fn, name, options string) error {
+	abs, err := filepath.Abs(fn)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return err
+	}
+	git := "git -c user.name=goes-build -c user.email=goes-build@localhost"
+	if options != "" {
+		options += " "
+	}
+	cmd := git + " am -q --keep-cr " + options + abs
+	if !bytes.HasPrefix(b, []byte("From ")) {
+		cmd = "git apply --index " + options + abs +
+			" && " + git + " commit -q -m 'goes-build patch " + name + "'"
+	}
+	if err = shellCommandRun("cd " + workdir + " && " + cmd); err != nil {
+		return fmt.Errorf("%s: %s doesn't apply", workdir, fn)
+	}
+	return nil
+}
+
+// patchedBase returns the commit the patch series applied to the worktree
+// in dir is based on, or the empty string.
+func patchedBase(dir string) string {
+	if st := readPatchStamp(dir); st != nil {
+		return st.Base
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPatchSeries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goes-build-patches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.patch", "b.patch"} {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), nil,
+			0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		series  string
+		options []string
+		ok      bool
+	}{
+		{"a.patch\nb.patch\n", []string{"", ""}, true},
+		{"# comment\na.patch -p0\nb.patch -p1 # comment\n",
+			[]string{"-p0", "-p1"}, true},
+		{"a.patch -R\n", nil, false},
+		{"a.patch -p1 -R\n", nil, false},
+	} {
+		if err = ioutil.WriteFile(filepath.Join(dir, "series"),
+			[]byte(tc.series), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ps, err := loadPatchSeries(dir)
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: err = %v", tc.series, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for i, p := range ps.patches {
+			if p.Options != tc.options[i] {
+				t.Errorf("%q: %s options %q, want %q", tc.series,
+					p.Name, p.Options, tc.options[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// repoRefs maps REPO or MACHINE/REPO to the ref its worktrees are checked
+// out at, from -ref over the configuration's Refs.
+var repoRefs = map[string]string{}
+
+// worktree returns the repository and machine of the worktree tg is built
+// in, or empty strings if it isn't built in one.
+func (tg *target) worktree() (repo, machine string) {
+	for _, suffix := range []string{".vmlinuz", ".deb"} {
+		if strings.HasSuffix(tg.name, suffix) {
+			return "linux", strings.TrimSuffix(tg.name, suffix)
+		}
+	}
+	if tg.env != nil && tg.env.boot != "" &&
+		strings.HasPrefix(tg.name, tg.env.boot+"-") &&
+		!strings.Contains(tg.name, ".") {
+		return tg.env.boot, strings.TrimPrefix(tg.name, tg.env.boot+"-")
+	}
+	return "", ""
+}
+
+// worktreeRef returns the ref to check out in the worktree of repo for
+// machine: a MACHINE/REPO override, then REPO, then -branch.
+func worktreeRef(repo, machine string) string {
+	if ref, found := repoRefs[machine+"/"+repo]; found {
+		return ref
+	}
+	if ref, found := repoRefs[repo]; found {
+		return ref
+	}
+	return *branchFlag
+}
+
+// checkRefs verifies that every -ref names a worktree repository and that
+// the refs of the worktrees the targets are built in exist, so a typo
+// fails before hours of building.
+func checkRefs(tgs []*target) error {
+	for key := range repoRefs {
+		repo := key[strings.LastIndexByte(key, '/')+1:]
+		known := false
+		for _, r := range worktreeRepos {
+			known = known || r == repo
+		}
+		if !known {
+			return fmt.Errorf("-ref %s: unknown repository %s; "+
+				"use one of %s", key, repo,
+				strings.Join(worktreeRepos, ", "))
+		}
+	}
+	refs := map[string]string{}
+	visited := map[*target]bool{}
+	var visit func(tg *target)
+	visit = func(tg *target) {
+		if visited[tg] {
+			return
+		}
+		visited[tg] = true
+		for _, dep := range tg.dependencies {
+			visit(dep)
+		}
+		repo, machine := tg.worktree()
+		if repo == "" {
+			return
+		}
+		if ref := worktreeRef(repo, machine); ref != "" {
+			refs[machine+"/"+repo] = ref
+		}
+	}
+	for _, tg := range tgs {
+		visit(tg)
+	}
+	bad := []string{}
+	for key, ref := range refs {
+		repo := key[strings.LastIndexByte(key, '/')+1:]
+		gitdir, err := findGitdir(repo)
+		if err != nil {
+			return err
+		}
+		if _, err = resolveRef(gitdir, ref); err != nil {
+			bad = append(bad, key+"="+ref)
+		}
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("unknown refs: %s", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// resolveRef returns the commit ref names in the git tree dir.
+func resolveRef(dir, ref string) (string, error) {
+	return shellCommandOutput("cd " + dir +
+		" && git rev-parse -q --verify '" + ref + "^{commit}'")
+}
+
+// worktreeBase returns the commit to check out in the worktree of repo
+// for machine: the locked commit with -locked, otherwise that of its ref,
+// or the empty string to keep the current one.
+func worktreeBase(repo, machine, workdir string) (string, error) {
+	if commit, err := lockedCommit(repo); commit != "" || err != nil {
+		return commit, err
+	}
+	ref := worktreeRef(repo, machine)
+	if ref == "" || *nFlag {
+		return "", nil
+	}
+	commit, err := resolveRef(workdir, ref)
+	if err != nil {
+		return "", fmt.Errorf("%s: unknown ref %s", workdir, ref)
+	}
+	return commit, nil
+}
@@ -0,0 +1,87 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// dirtySuffix marks version stamps of builds from trees with uncommitted
+// changes or untracked files.
+const dirtySuffix = "-dirty"
+
+type sourceTreeState struct {
+	dirty  bool
+	tagged bool
+}
+
+var (
+	sourceTrees      = map[string]*sourceTreeState{}
+	sourceTreesMutex sync.Mutex
+)
+
+// gitDirty reports whether the git tree in dir has uncommitted changes or
+// untracked files.
+func gitDirty(dir string) (bool, error) {
+	out, err := shellCommandOutput("cd " + dir +
+		" && git status --porcelain")
+	if err != nil {
+		return false, err
+	}
+	return len(out) > 0, nil
+}
+
+// gitTagged reports whether HEAD of the git tree in dir is tagged or, for a
+// worktree carrying a patch series, whether the commit it applies to is.
+func gitTagged(dir string) bool {
+	rev := "HEAD"
+	if base := patchedBase(dir); base != "" {
+		rev = base
+	}
+	_, err := shellCommandOutput("cd " + dir +
+		" && git describe --tags --exact-match " + rev + " 2>/dev/null")
+	return err == nil
+}
+
+// checkSourceTree returns the suffix to append to version stamps of
+// builds from the git tree in dir. In -release mode it refuses trees that
+// are dirty or whose HEAD isn't tagged.
+func checkSourceTree(dir string) (suffix string, err error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return
+	}
+	sourceTreesMutex.Lock()
+	st, found := sourceTrees[abs]
+	sourceTreesMutex.Unlock()
+	if !found {
+		st = &sourceTreeState{tagged: true}
+		if st.dirty, err = gitDirty(abs); err != nil {
+			return
+		}
+		if *releaseFlag {
+			st.tagged = gitTagged(abs)
+		}
+		sourceTreesMutex.Lock()
+		sourceTrees[abs] = st
+		sourceTreesMutex.Unlock()
+	}
+	if *releaseFlag {
+		if st.dirty {
+			return "", fmt.Errorf("%s has uncommitted changes or "+
+				"untracked files; not building a release", dir)
+		}
+		if !st.tagged {
+			return "", fmt.Errorf("%s is not at a tag; "+
+				"not building a release", dir)
+		}
+	}
+	if st.dirty {
+		suffix = dirtySuffix
+	}
+	return
+}
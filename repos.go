@@ -0,0 +1,72 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// repoEnvPrefix prefixes environment variables naming a repository path,
+// e.g. GOES_BUILD_REPO_U_BOOT for u-boot.
+const repoEnvPrefix = "GOES_BUILD_REPO_"
+
+// repoPaths holds the repository paths given with -repo.
+var repoPaths = map[string]string{}
+
+func repoEnv(repo string) string {
+	return repoEnvPrefix + strings.Map(func(r rune) rune {
+		if r == '-' || r == '.' {
+			return '_'
+		}
+		return r
+	}, strings.ToUpper(repo))
+}
+
+// repoSearchPath returns the paths to look for repo in, and where an
+// explicit path came from, for error messages.
+func repoSearchPath(repo string) (dirs []string, source string) {
+	path, env := "", repoEnv(repo)
+	if p, found := repoPaths[repo]; found {
+		path, source = p, " (from -repo)"
+	} else if p := os.Getenv(env); p != "" {
+		path, source = p, " (from "+env+")"
+	} else if p, found := cfg.Repos[repo]; found {
+		path, source = p, " (from "+*configFlag+")"
+	}
+	if path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(*platinaPath, path)
+		}
+		return []string{path}, source
+	}
+	for _, dir := range []string{
+		filepath.Join(*platinaPath, repo),
+		filepath.Join(*platinaPath, "src", repo),
+		filepath.Join(*platinaPath, platinaSystemBuildSrcDir, repo),
+	} {
+		dirs = append(dirs, dir, dir+".git")
+	}
+	return
+}
+
+// isGitRepo reports whether dir is a git work tree or a bare repository.
+func isGitRepo(dir string) bool {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+		return true
+	}
+	return isBareRepo(dir)
+}
+
+// isBareRepo reports whether dir is a bare repository, e.g. a mirror.
+func isBareRepo(dir string) bool {
+	for _, fn := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); err != nil {
+			return false
+		}
+	}
+	return true
+}
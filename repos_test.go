@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestRepoSearchPath(t *testing.T) {
+	if env := repoEnv("u-boot"); env != "GOES_BUILD_REPO_U_BOOT" {
+		t.Errorf("repoEnv(u-boot) = %s", env)
+	}
+	defer func(p string) { *platinaPath = p }(*platinaPath)
+	*platinaPath = "/src"
+	cfg.Repos = map[string]string{"linux": "mirrors/linux.git"}
+	defer func() { cfg.Repos = nil }()
+
+	dirs, _ := repoSearchPath("linux")
+	if len(dirs) != 1 || dirs[0] != "/src/mirrors/linux.git" {
+		t.Errorf("config: got %v", dirs)
+	}
+	os.Setenv("GOES_BUILD_REPO_LINUX", "/mirror/linux.git")
+	defer os.Unsetenv("GOES_BUILD_REPO_LINUX")
+	dirs, _ = repoSearchPath("linux")
+	if len(dirs) != 1 || dirs[0] != "/mirror/linux.git" {
+		t.Errorf("environment: got %v", dirs)
+	}
+	repoPaths["linux"] = "linux-next"
+	defer delete(repoPaths, "linux")
+	dirs, _ = repoSearchPath("linux")
+	if len(dirs) != 1 || dirs[0] != "/src/linux-next" {
+		t.Errorf("-repo: got %v", dirs)
+	}
+	dirs, _ = repoSearchPath("coreboot")
+	if len(dirs) != 6 || dirs[0] != "/src/coreboot" ||
+		dirs[1] != "/src/coreboot.git" {
+		t.Errorf("search: got %v", dirs)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxReportSymbols limits the symbols kept in a size report to the
+// largest ones.
+const maxReportSymbols = 200
+
+// sizeReport breaks a goes binary down by Go package and symbol using its
+// ELF symbol table.
+type sizeReport struct {
+	Binary   string
+	Stripped int64 `json:",omitempty"`
+	Symbols  int64 // total size of sized symbols
+	Packages []sizeEntry
+	Largest  []sizeEntry
+}
+
+type sizeEntry struct {
+	Name string
+	Size int64
+}
+
+// newSizeReport reads the symbol table of the unstripped binary fn.
+func newSizeReport(name, fn string) (*sizeReport, error) {
+	f, err := elf.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	r := &sizeReport{Binary: name}
+	pkgs := map[string]int64{}
+	for _, sym := range syms {
+		if sym.Size == 0 || sym.Section == elf.SHN_UNDEF {
+			continue
+		}
+		switch elf.ST_TYPE(sym.Info) {
+		case elf.STT_FUNC, elf.STT_OBJECT:
+		default:
+			continue
+		}
+		size := int64(sym.Size)
+		r.Symbols += size
+		pkgs[symbolPackage(sym.Name)] += size
+		r.Largest = append(r.Largest, sizeEntry{sym.Name, size})
+	}
+	for pkg, size := range pkgs {
+		r.Packages = append(r.Packages, sizeEntry{pkg, size})
+	}
+	sortSizes(r.Packages)
+	sortSizes(r.Largest)
+	if len(r.Largest) > maxReportSymbols {
+		r.Largest = r.Largest[:maxReportSymbols]
+	}
+	return r, nil
+}
+
+func sortSizes(s []sizeEntry) {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Size != s[j].Size {
+			return s[i].Size > s[j].Size
+		}
+		return s[i].Name < s[j].Name
+	})
+}
+
+// symbolPackage returns the Go package path of a symbol name such as
+// github.com/platinasystems/vnet.(*Vnet).Run, or a pseudo package for
+// linker generated type and runtime data.
+func symbolPackage(name string) string {
+	for _, prefix := range []string{"type:", "type.", "go:", "go."} {
+		if strings.HasPrefix(name, prefix) {
+			return "(" + strings.TrimRight(prefix, ":.") + " data)"
+		}
+	}
+	path := name
+	if i := strings.IndexByte(path, '['); i >= 0 {
+		path = path[:i] // generic instantiation
+	}
+	slash := strings.LastIndexByte(path, '/') + 1
+	if dot := strings.IndexByte(path[slash:], '.'); dot >= 0 {
+		return path[:slash+dot]
+	}
+	return "(other)"
+}
+
+func readSizeReport(fn string) (*sizeReport, error) {
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	r := &sizeReport{}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("%s: %s", fn, err)
+	}
+	return r, nil
+}
+
+func (r *sizeReport) write(fn string) error {
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	host.log("{size}write", fn)
+	return ioutil.WriteFile(fn, append(b, '\n'), 0644)
+}
+
+// sizeDelta is the change of a package between two size reports.
+type sizeDelta struct {
+	Name     string
+	Old, New int64
+}
+
+// diff returns the packages whose size differs between old and
+// r, largest change first.
+func (r *sizeReport) diff(old *sizeReport) (deltas []sizeDelta) {
+	oldPkgs := map[string]int64{}
+	for _, e := range old.Packages {
+		oldPkgs[e.Name] = e.Size
+	}
+	for _, e := range r.Packages {
+		if e.Size != oldPkgs[e.Name] {
+			deltas = append(deltas, sizeDelta{e.Name,
+				oldPkgs[e.Name], e.Size})
+		}
+		delete(oldPkgs, e.Name)
+	}
+	for name, size := range oldPkgs {
+		deltas = append(deltas, sizeDelta{name, size, 0})
+	}
+	abs := func(d sizeDelta) int64 {
+		if d.New > d.Old {
+			return d.New - d.Old
+		}
+		return d.Old - d.New
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		if abs(deltas[i]) != abs(deltas[j]) {
+			return abs(deltas[i]) > abs(deltas[j])
+		}
+		return deltas[i].Name < deltas[j].Name
+	})
+	return
+}
+
+// print shows the largest packages of r, or if a report of the same
+// binary is in -sizebase, the packages that changed most since then.
+func (r *sizeReport) print(lines int) {
+	if *sizeBaseFlag != "" {
+		old, err := readSizeReport(filepath.Join(*sizeBaseFlag,
+			r.Binary+".size.json"))
+		if err == nil {
+			fmt.Printf("# %s size change by package since %s "+
+				"(symbols %+d bytes):\n", r.Binary, *sizeBaseFlag,
+				r.Symbols-old.Symbols)
+			for i, d := range r.diff(old) {
+				if i == lines {
+					break
+				}
+				fmt.Printf("#\t%+10d %10d %s\n", d.New-d.Old,
+					d.New, d.Name)
+			}
+			return
+		}
+		if !os.IsNotExist(err) {
+			fmt.Printf("# %s\n", err)
+		}
+	}
+	fmt.Printf("# %s largest packages:\n", r.Binary)
+	for i, e := range r.Packages {
+		if i == lines {
+			break
+		}
+		fmt.Printf("#\t%10d %s\n", e.Size, e.Name)
+	}
+}
+
+// checkBinarySize strips the goes binary of tg, keeping the stripped copy
+// for its initramfs, reports its size by package to -sizereport and fails
+// if it exceeds the binary budget.
+func (goenv *goenv) checkBinarySize(tg *target, bin string) error {
+	budget := tg.binaryBudget
+	if b, found := cfg.BinaryBudget[tg.name]; found {
+		budget = b
+	}
+	if *nFlag || (budget == 0 && *sizeReportFlag == "") {
+		return nil
+	}
+	r, err := newSizeReport(tg.output(), bin)
+	if err != nil {
+		return err
+	}
+	stripped, err := goenv.stripBinary(bin)
+	if err != nil {
+		return err
+	}
+	r.Stripped = int64(len(stripped))
+	if *sizeReportFlag != "" {
+		if err = os.MkdirAll(*sizeReportFlag, 0755); err != nil {
+			return err
+		}
+		if err = r.write(filepath.Join(*sizeReportFlag,
+			r.Binary+".size.json")); err != nil {
+			return err
+		}
+		if *zFlag {
+			r.print(10)
+		}
+	}
+	if budget > 0 && r.Stripped > budget {
+		r.print(20)
+		return fmt.Errorf("stripped %s size of %d exceeds budget of %d",
+			tg.output(), r.Stripped, budget)
+	}
+	return nil
+}
+
+// budget returns the size budget of the artifact of tg, or 0 if it has
+// none: the configured one, or that tg declares for the flash layout.
+func (tg *target) budget() int64 {
+	if b, found := cfg.SizeBudget[tg.name]; found {
+		return b
+	}
+	if *legacyFlag && tg.legacyBudget > 0 {
+		return tg.legacyBudget
+	}
+	return tg.sizeBudget
+}
+
+// checkFileSize fails if the artifact fn of tg exceeds its size budget.
+func checkFileSize(tg *target, fn string) error {
+	budget := tg.budget()
+	if *nFlag || budget == 0 {
+		return nil
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > budget {
+		return fmt.Errorf("%s size of %d exceeds budget of %d",
+			fn, fi.Size(), budget)
+	}
+	return nil
+}
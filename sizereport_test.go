@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestSymbolPackage(t *testing.T) {
+	for _, tc := range []struct {
+		sym, pkg string
+	}{
+		{"main.main", "main"},
+		{"runtime.mallocgc", "runtime"},
+		{"github.com/platinasystems/vnet.(*Vnet).Run",
+			"github.com/platinasystems/vnet"},
+		{"github.com/platinasystems/go-cpio.NewWriter",
+			"github.com/platinasystems/go-cpio"},
+		{"vendor/golang.org/x/net/dns/dnsmessage.(*Parser).Start",
+			"vendor/golang.org/x/net/dns/dnsmessage"},
+		{"sort.Slice[go.shape.struct { a/b.c int }]", "sort"},
+		{"type:*os.File", "(type data)"},
+		{"go:buildinfo", "(go data)"},
+		{"_cgo_init", "(other)"},
+	} {
+		if pkg := symbolPackage(tc.sym); pkg != tc.pkg {
+			t.Errorf("symbolPackage(%q) = %q, want %q", tc.sym, pkg,
+				tc.pkg)
+		}
+	}
+}
+
+func TestSizeReportDiff(t *testing.T) {
+	old := &sizeReport{Packages: []sizeEntry{
+		{"runtime", 1000}, {"main", 100}, {"gone", 50},
+	}}
+	r := &sizeReport{Packages: []sizeEntry{
+		{"runtime", 1010}, {"main", 100}, {"vnet", 500},
+	}}
+	d := r.diff(old)
+	if len(d) != 3 || d[0].Name != "vnet" || d[1].Name != "gone" ||
+		d[2].Name != "runtime" {
+		t.Errorf("got %+v", d)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// updateSubmodules checks out the submodules of the worktree at the
+// commits its HEAD records, cloning them from the local clone of repo, or
+// its mirror, never from the URLs in .gitmodules. Submodules marked
+// update = none, like coreboot's optional blobs, are left alone. It
+// returns the commit of each submodule by path.
+func updateSubmodules(repo, workdir string) (map[string]string, error) {
+	if *nFlag {
+		return nil, nil
+	}
+	modules, err := submodules(workdir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", workdir, err)
+	}
+	if len(modules) == 0 {
+		return nil, nil
+	}
+	names := []string{}
+	for name := range modules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	skip := map[string]bool{}
+	for _, name := range names {
+		path := modules[name]
+		update, _ := shellCommandOutput("cd " + workdir +
+			" && git config --blob HEAD:.gitmodules" +
+			" submodule." + name + ".update")
+		if update == "none" {
+			skip[path] = true
+			continue
+		}
+		src, err := submoduleLocalSource(repo, name, path)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = os.Stat(filepath.Join(workdir, path,
+			".git")); err == nil {
+			if err = shellCommandRun("cd " + filepath.Join(workdir,
+				path) + " && git remote set-url origin " +
+				src); err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", workdir,
+					path, err)
+			}
+		}
+		if err = shellCommandRun("cd " + workdir +
+			" && git -c protocol.file.allow=always" +
+			" -c 'submodule." + name + ".url=" + src + "'" +
+			" submodule update -q --init --checkout -- " +
+			path); err != nil {
+			return nil, fmt.Errorf("%s: can't check out submodule "+
+				"%s from %s: %s", workdir, path, src, err)
+		}
+	}
+	out, err := shellCommandOutput("cd " + workdir +
+		" && git submodule status")
+	if err != nil {
+		return nil, fmt.Errorf("%s: git submodule status: %s", workdir,
+			err)
+	}
+	commits, bad := checkSubmoduleStatus(out, skip)
+	if len(bad) > 0 {
+		return nil, fmt.Errorf("%s: submodules not at the commits "+
+			"recorded by HEAD: %s", workdir, strings.Join(bad, ", "))
+	}
+	return commits, nil
+}
+
+// submoduleLocalSource returns where to clone the submodule name at path
+// of repo from: its mirror with -offline, otherwise its checkout in the
+// local clone of repo, falling back to the mirror.
+func submoduleLocalSource(repo, name, path string) (string, error) {
+	mirror := submoduleMirror(repo, name)
+	if !*offlineFlag {
+		gitdir, err := findSourceGitdir(repo)
+		if err != nil {
+			return "", err
+		}
+		if src := submoduleSource(gitdir, name, path); src != "" {
+			return src, nil
+		}
+		if !isBareRepo(mirror) {
+			return "", fmt.Errorf("%s: submodule %s isn't checked "+
+				"out in %s; run git -C %s submodule update "+
+				"--init %s", repo, path, gitdir, gitdir, path)
+		}
+	} else if !isBareRepo(mirror) {
+		return "", fmt.Errorf("%s: no mirror of submodule %s in %s; "+
+			"run goes-build mirror %s first", repo, path,
+			*mirrorsFlag, repo)
+	}
+	return filepath.Abs(mirror)
+}
+
+// checkSubmoduleStatus parses git submodule status, returning the commit
+// of each submodule by path and those not checked out at the commit the
+// superproject records, except the paths in skip.
+func checkSubmoduleStatus(out string, skip map[string]bool) (commits map[string]string, bad []string) {
+	commits = map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		if len(line) < 2 {
+			continue
+		}
+		f := strings.Fields(line[1:])
+		if len(f) < 2 || skip[f[1]] {
+			continue
+		}
+		switch line[0] {
+		case ' ':
+			commits[f[1]] = f[0]
+		case '-':
+			bad = append(bad, f[1]+" (not checked out)")
+		case '+':
+			bad = append(bad, f[1]+" (at "+f[0]+")")
+		case 'U':
+			bad = append(bad, f[1]+" (merge conflicts)")
+		}
+	}
+	return
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckSubmoduleStatus(t *testing.T) {
+	out := " 705b62c3 3rdparty/blobs (heads/master)\n" +
+		"+1a2b3c4d 3rdparty/vboot (v1.0)\n" +
+		"-5e6f7a8b 3rdparty/fsp\n" +
+		"-9c0d1e2f 3rdparty/intel-microcode\n"
+	commits, bad := checkSubmoduleStatus(out,
+		map[string]bool{"3rdparty/intel-microcode": true})
+	if !reflect.DeepEqual(commits,
+		map[string]string{"3rdparty/blobs": "705b62c3"}) {
+		t.Errorf("commits = %v", commits)
+	}
+	want := []string{"3rdparty/vboot (at 1a2b3c4d)",
+		"3rdparty/fsp (not checked out)"}
+	if !reflect.DeepEqual(bad, want) {
+		t.Errorf("bad = %q, want %q", bad, want)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// User tags given with -tags. A target accepts a tag by listing it in
+// its userTags along with any go build options the tag implies; accepted
+// tags are also passed to go build as build tags.
+const (
+	tagDebug = "debug"
+	tagDiag  = "diag"
+)
+
+var (
+	debugGoflags = goflags{gcflags: "-N -l"}
+
+	goUserTags = map[string]goflags{
+		tagDebug: debugGoflags,
+	}
+	// Only the BMC goes binaries build the manufacturing diagnostics.
+	bmcUserTags = map[string]goflags{
+		tagDebug: debugGoflags,
+		tagDiag:  {},
+	}
+	// Kernels merge the kernelTagFragments of their tags.
+	kernelUserTags = map[string]goflags{
+		tagDebug: {},
+	}
+)
+
+// userTags returns the tags given with -tags.
+func userTags() []string {
+	return strings.FieldsFunc(*tagsFlag, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// activeUserTags returns the -tags tags accepted by tg.
+func (tg *target) activeUserTags() (tags []string) {
+	for _, tag := range userTags() {
+		if _, found := tg.userTags[tag]; found {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
+
+// acceptedTags returns the sorted tags tg accepts.
+func (tg *target) acceptedTags() (tags []string) {
+	for tag := range tg.userTags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return
+}
+
+// checkTags rejects -tags tags that no target accepts, or that none of
+// tgs or their dependencies accept.
+func checkTags(tgs []*target) error {
+	used := map[string]bool{}
+	var visit func(tg *target)
+	visit = func(tg *target) {
+		for tag := range tg.userTags {
+			used[tag] = true
+		}
+		for _, dep := range tg.dependencies {
+			visit(dep)
+		}
+	}
+	for _, tg := range tgs {
+		visit(tg)
+	}
+	for _, tag := range userTags() {
+		known := false
+		for _, tg := range allTargets {
+			if _, found := tg.userTags[tag]; found {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown tag %q", tag)
+		}
+		if !used[tag] {
+			names := []string{}
+			for _, tg := range tgs {
+				names = append(names, tg.name)
+			}
+			return fmt.Errorf("tag %q does not apply to %s", tag,
+				strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
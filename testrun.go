@@ -0,0 +1,180 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const defaultTestTimeout = 10 * time.Minute
+
+// qemuUser maps a GOARCH to the qemu user mode emulator able to run its
+// binaries on another host.
+var qemuUser = map[string]string{
+	"amd64": "qemu-x86_64",
+	"arm":   "qemu-arm",
+	"arm64": "qemu-aarch64",
+}
+
+func (tg *target) isTest() bool {
+	return strings.HasSuffix(tg.name, ".test")
+}
+
+// runTests builds the named test targets, or all of them, runs each test
+// binary and writes go test2json and JUnit XML results to -testout.
+func runTests(args []string) error {
+	tgs := []*target{}
+	if len(args) == 0 {
+		for _, tg := range allTargets {
+			if tg.isTest() {
+				tgs = append(tgs, tg)
+			}
+		}
+	} else {
+		sel, err := selectTargets(args)
+		if err != nil {
+			return err
+		}
+		for _, tg := range sel {
+			if !tg.isTest() {
+				return fmt.Errorf("%s is not a test target", tg.name)
+			}
+			tgs = append(tgs, tg)
+		}
+	}
+	if err := checkTags(tgs); err != nil {
+		return err
+	}
+	lock, err := lockOutputs()
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	makeTargets("", tgs)
+	if *nFlag {
+		return nil
+	}
+	if err := os.MkdirAll(*testOutFlag, 0755); err != nil {
+		return err
+	}
+	failed := []string{}
+	for _, tg := range tgs {
+		ts, err := runTestBinary(tg)
+		if err != nil {
+			return err
+		}
+		fn := filepath.Join(*testOutFlag, tg.name+".xml")
+		f, err := os.Create(fn)
+		if err != nil {
+			return err
+		}
+		err = ts.write(f)
+		if errclose := f.Close(); err == nil {
+			err = errclose
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("# %s: %d tests, %d failures, %d skipped\n",
+			tg.name, ts.Tests, ts.Failures, ts.Skipped)
+		if ts.Failures > 0 {
+			failed = append(failed, tg.name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// runTestBinary runs the test binary of tg through go tool test2json,
+// under qemu user mode emulation if tg is for another GOARCH.
+func runTestBinary(tg *target) (*junitTestSuite, error) {
+	timeout := tg.testTimeout
+	if timeout == 0 {
+		timeout = defaultTestTimeout
+	}
+	props := []junitProperty{
+		{"goarch", tg.env.goarch},
+		{"timeout", timeout.String()},
+		{"privileged", strconv.FormatBool(tg.testPrivileged)},
+	}
+	if tg.testPrivileged && os.Geteuid() != 0 {
+		fmt.Printf("# %s requires root, skipped\n", tg.name)
+		ts := junitSkipped(tg.name, "requires root")
+		ts.Properties = props
+		return ts, nil
+	}
+	dir := filepath.Join(*platinaPath, tg.dirName)
+	argv := []string{"./" + tg.name}
+	if tg.env.goarch != runtime.GOARCH {
+		qemu, err := exec.LookPath(qemuUser[tg.env.goarch])
+		if err != nil {
+			fmt.Printf("# %s needs %s, skipped\n", tg.name,
+				qemuUser[tg.env.goarch])
+			ts := junitSkipped(tg.name, "no "+
+				qemuUser[tg.env.goarch]+" in PATH")
+			ts.Properties = props
+			return ts, nil
+		}
+		argv = append([]string{qemu}, argv...)
+		props = append(props, junitProperty{"emulator", qemu})
+	}
+	tc, err := tg.env.goToolchain(tg)
+	if err != nil {
+		return nil, err
+	}
+	// Test binaries accept -test.v=test2json, which keeps their
+	// output framed for test2json, as of Go 1.20.
+	verbose := "-test.v"
+	if versionAtLeast(tc.version, "1.20") {
+		verbose = "-test.v=test2json"
+	}
+	argv = append(argv, verbose, "-test.timeout="+timeout.String())
+
+	// test.timeout makes the binary panic; the context catches one
+	// that hangs regardless, e.g. under qemu.
+	ctx, cancel := context.WithTimeout(context.Background(),
+		timeout+time.Minute)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, tc.path, append([]string{"tool",
+		"test2json", "-t", "-p", tg.name}, argv...)...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), tc.env...)
+	fn := filepath.Join(*testOutFlag, tg.name+".json")
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out bytes.Buffer
+	cmd.Stdout = io.MultiWriter(f, &out)
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Pdeathsig: syscall.SIGTERM,
+	}
+	host.log(cmd.Args...)
+	exitErr := cmd.Run()
+	if ctx.Err() != nil {
+		exitErr = fmt.Errorf("killed after %s", timeout+time.Minute)
+	}
+	ts, err := junitFromTest2JSON(tg.name, &out, exitErr)
+	if err != nil {
+		return nil, err
+	}
+	ts.Properties = props
+	return ts, nil
+}
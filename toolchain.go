@@ -0,0 +1,67 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// crossCompile returns the cross compiler prefix of goenv, suitable for
+// CROSS_COMPILE. The prefix is taken from -gnuprefix or the configuration
+// file if given there, otherwise the first candidate prefix with a gcc in
+// PATH is used. The result is cached and recorded in the build manifest.
+func (goenv *goenv) crossCompile() (string, error) {
+	goenv.prefixOnce.Do(func() {
+		goenv.gnuPrefix, goenv.prefixErr = goenv.findCrossCompile()
+		if goenv.prefixErr != nil {
+			return
+		}
+		ti := &toolchainInfo{Prefix: goenv.gnuPrefix}
+		if !*nFlag {
+			ti.Version = toolVersion(goenv.gnuPrefix+"gcc",
+				"--version")
+		}
+		manifest.setToolchain(goenv.goarch, ti)
+		goenv.log("{toolchain}", goenv.gnuPrefix+"gcc", ti.Version)
+	})
+	return goenv.gnuPrefix, goenv.prefixErr
+}
+
+func (goenv *goenv) findCrossCompile() (string, error) {
+	if prefix, found := gnuPrefixes[goenv.goarch]; found {
+		return prefix, nil
+	}
+	if prefix, found := cfg.GnuPrefix[goenv.goarch]; found {
+		return prefix, nil
+	}
+	if len(goenv.gnuPrefixes) == 0 {
+		return "", nil
+	}
+	tried := []string{}
+	for _, prefix := range goenv.gnuPrefixes {
+		if _, err := exec.LookPath(prefix + "gcc"); err == nil {
+			return prefix, nil
+		}
+		tried = append(tried, prefix+"gcc")
+	}
+	if *nFlag {
+		return goenv.gnuPrefixes[0], nil
+	}
+	return "", fmt.Errorf("no %s cross compiler in PATH (tried %s); "+
+		"use -gnuprefix %s=PREFIX",
+		goenv.goarch, strings.Join(tried, ", "), goenv.goarch)
+}
+
+// toolVersion returns the first line printed by a tool's version option,
+// or the empty string if it can't be run.
+func toolVersion(tool string, args ...string) string {
+	out, err := exec.Command(tool, args...).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
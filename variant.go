@@ -0,0 +1,144 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Instrumented build variants selected with -variant. A target lists the
+// variants it can be built as; its artifacts are then named with the
+// variant as a suffix, e.g. goes-platina-mk1-race.
+const (
+	variantRace  = "race"
+	variantCover = "cover"
+)
+
+// coverGoVersion is the first Go release whose go build takes -cover and
+// whose binaries write GOCOVERDIR data.
+const coverGoVersion = "1.20"
+
+var (
+	variantGoflags = map[string]goflags{
+		variantRace:  {race: true},
+		variantCover: {cover: true},
+	}
+
+	// raceArchs are the GOARCHes supported by the race detector.
+	raceArchs = map[string]bool{
+		"amd64":   true,
+		"arm64":   true,
+		"ppc64le": true,
+		"s390x":   true,
+	}
+)
+
+// variant returns the -variant tg is built as, or the empty string if tg
+// doesn't support it.
+func (tg *target) variant() string {
+	for _, v := range tg.variants {
+		if v == *variantFlag {
+			return v
+		}
+	}
+	return ""
+}
+
+// output returns the file name of tg's artifact, suffixed with its
+// variant.
+func (tg *target) output() string {
+	if v := tg.variant(); v != "" {
+		return tg.name + "-" + v
+	}
+	return tg.name
+}
+
+// checkVariant verifies that -variant is known and that each of the named
+// targets can be built as it.
+func checkVariant(tgs []*target) error {
+	if *variantFlag == "" {
+		return nil
+	}
+	if _, found := variantGoflags[*variantFlag]; !found {
+		return fmt.Errorf("unknown variant %q", *variantFlag)
+	}
+	for _, tg := range tgs {
+		if tg.variant() == "" {
+			return fmt.Errorf("%s has no %s variant", tg.name,
+				*variantFlag)
+		}
+		if tg.variant() == variantRace && !raceArchs[tg.env.goarch] {
+			return fmt.Errorf("%s: -race is not supported on %s",
+				tg.name, tg.env.goarch)
+		}
+		if tg.variant() == variantCover {
+			tc, err := tg.env.goToolchain(tg)
+			if err != nil {
+				return err
+			}
+			if !versionAtLeast(tc.version, coverGoVersion) {
+				return fmt.Errorf("%s: -variant cover needs go%s or later, not %s; see -goversion",
+					tg.name, coverGoVersion, tc.version)
+			}
+		}
+	}
+	return nil
+}
+
+// collectCoverage gathers the GOCOVERDIR data found beneath the given
+// directories, e.g. copied off test boots of cover variant images, merges
+// it into -covout and writes a text profile and per package summary with
+// the -goversion toolchain, or the go in PATH.
+func collectCoverage(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no GOCOVERDIR directories given")
+	}
+	dirs := []string{}
+	for _, arg := range args {
+		err := filepath.Walk(arg, func(path string, info os.FileInfo,
+			err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				return nil
+			}
+			if m, _ := filepath.Glob(filepath.Join(path,
+				"covmeta.*")); len(m) > 0 {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(dirs) == 0 {
+		return fmt.Errorf("no coverage data found in %s",
+			strings.Join(args, " "))
+	}
+	if err := os.MkdirAll(*covOutFlag, 0755); err != nil {
+		return err
+	}
+	tc, err := findGoToolchain(*goVersionFlag)
+	if err != nil {
+		return err
+	}
+	if !versionAtLeast(tc.version, coverGoVersion) {
+		return fmt.Errorf("go tool covdata needs go%s or later, not %s; see -goversion",
+			coverGoVersion, tc.version)
+	}
+	covdata := strings.Join(append(tc.env, tc.path), " ") +
+		" tool covdata"
+	in := strings.Join(dirs, ",")
+	return shellCommandRun(covdata + " merge -i=" + in +
+		" -o=" + *covOutFlag +
+		" && " + covdata + " textfmt -i=" + *covOutFlag +
+		" -o=" + *covOutFlag + ".txt" +
+		" && " + covdata + " percent -i=" + *covOutFlag)
+}
@@ -0,0 +1,398 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	vulnDBOnce    sync.Once
+	vulnDBEntries []*osvEntry
+	vulnDBErr     error
+)
+
+// osvEntry is the subset of an OSV vulnerability report, as published in
+// the Go vulnerability database, used by vulncheck.
+type osvEntry struct {
+	ID       string
+	Aliases  []string
+	Summary  string
+	Affected []struct {
+		Package struct {
+			Name      string
+			Ecosystem string
+		}
+		Ranges []struct {
+			Type   string
+			Events []struct {
+				Introduced string
+				Fixed      string
+			}
+		}
+		EcosystemSpecific struct {
+			Imports []struct {
+				Path    string
+				Symbols []string
+			}
+		} `json:"ecosystem_specific"`
+	}
+}
+
+// vulnFinding is a vulnerability affecting a module linked into a binary.
+type vulnFinding struct {
+	entry   *osvEntry
+	module  string
+	version string
+	symbols []string // vulnerable symbols found in the binary
+	named   bool     // the entry names vulnerable symbols
+	unknown bool     // module version can't be determined
+}
+
+// reachable reports whether the finding should be treated as a
+// vulnerability of the binary: either its vulnerable symbols are linked
+// in, or the entry names no symbols to look for.
+func (f *vulnFinding) reachable() bool {
+	return len(f.symbols) > 0 || (!f.named && !f.unknown)
+}
+
+// loadVulnDB reads every OSV entry in the JSON files beneath dir.
+func loadVulnDB(dir string) (entries []*osvEntry, err error) {
+	err = filepath.Walk(dir, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(path) != ".json" {
+			return nil
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		e := &osvEntry{}
+		if json.Unmarshal(b, e) != nil || e.ID == "" ||
+			len(e.Affected) == 0 {
+			return nil // index or other non-entry file
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err == nil && len(entries) == 0 {
+		err = fmt.Errorf("no vulnerability entries found in %s", dir)
+	}
+	return
+}
+
+// vulnDB returns the directory and entries of the -vulndb database, read
+// once.
+func vulnDB() (string, []*osvEntry, error) {
+	dir := *vulnDBFlag
+	if dir == "" {
+		dir = cfg.VulnDB
+	}
+	if dir == "" {
+		return "", nil, fmt.Errorf("no vulnerability database; " +
+			"use -vulndb DIR")
+	}
+	vulnDBOnce.Do(func() {
+		vulnDBEntries, vulnDBErr = loadVulnDB(dir)
+	})
+	return dir, vulnDBEntries, vulnDBErr
+}
+
+// vulncheck scans the goes binaries of the named targets, and of the
+// targets they are made from, against the -vulndb database.
+func vulncheck(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no TARGET given")
+	}
+	tgs, err := selectTargets(args)
+	if err != nil {
+		return err
+	}
+	visited := map[*target]bool{}
+	found := 0
+	var visit func(tg *target) error
+	visit = func(tg *target) error {
+		if visited[tg] {
+			return nil
+		}
+		visited[tg] = true
+		for _, dep := range tg.dependencies {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		if !tg.isGoBinary() {
+			return nil
+		}
+		n, err := tg.env.vulncheckBinary(tg, filepath.Join(*platinaPath,
+			tg.dirName, tg.output()))
+		found += n
+		return err
+	}
+	for _, tg := range tgs {
+		if err = visit(tg); err != nil {
+			return err
+		}
+	}
+	if found > 0 {
+		return fmt.Errorf("%d vulnerabilities found", found)
+	}
+	return nil
+}
+
+// isGoBinary reports whether tg is a goes binary built with goDoForPkg.
+// The installer is the goes binary it embeds, which is its dependency.
+func (tg *target) isGoBinary() bool {
+	return tg.dirName != "" && !tg.isTest() &&
+		tg != goesPlatinaMk1Installer
+}
+
+// vulncheckBuilt scans the goes binary bin of tg just built for a
+// -release with a -vulndb, failing with -vulnfail if it is vulnerable.
+func (goenv *goenv) vulncheckBuilt(tg *target, bin string) error {
+	if *nFlag || !*releaseFlag || (*vulnDBFlag == "" && cfg.VulnDB == "") {
+		return nil
+	}
+	n, err := goenv.vulncheckBinary(tg, bin)
+	if err == nil && n > 0 && *vulnFailFlag {
+		err = fmt.Errorf("%s: %d vulnerabilities found; "+
+			"not building a release", tg.output(), n)
+	}
+	return err
+}
+
+// vulncheckBinary scans the goes binary bin of tg and writes the findings,
+// along with the database and binary checksum, to <output>.vulncheck.txt
+// as evidence of the scan. It returns the number of vulnerabilities whose
+// symbols are linked in.
+func (goenv *goenv) vulncheckBinary(tg *target, bin string) (int, error) {
+	db, entries, err := vulnDB()
+	if err != nil {
+		return 0, err
+	}
+	bi, err := goenv.readBuildInfo(tg, bin)
+	if err != nil {
+		return 0, err
+	}
+	symbols := map[string]bool{}
+	if f, err := elf.Open(bin); err == nil {
+		if syms, err := f.Symbols(); err == nil {
+			for _, sym := range syms {
+				symbols[sym.Name] = true
+			}
+		}
+		f.Close()
+	}
+	modules := map[string]string{
+		"stdlib": strings.TrimPrefix(bi.GoVersion, "go"),
+	}
+	for _, m := range bi.Deps {
+		version := m.Version
+		if m.Replace != nil {
+			version = m.Replace.Version
+		}
+		modules[m.Path] = version
+	}
+	findings := matchVulns(entries, modules, symbols)
+
+	b, err := ioutil.ReadFile(bin)
+	if err != nil {
+		return 0, err
+	}
+	var report strings.Builder
+	fmt.Fprintf(&report, "binary:   %s\n", tg.output())
+	fmt.Fprintf(&report, "sha256:   %x\n", sha256.Sum256(b))
+	fmt.Fprintf(&report, "go:       %s\n", bi.GoVersion)
+	fmt.Fprintf(&report, "database: %s (%d entries)\n", db, len(entries))
+	fmt.Fprintf(&report, "scanned:  %s\n", time.Now().UTC().Format(time.RFC3339))
+	n := 0
+	for _, f := range findings {
+		version, status := f.version, "not reachable"
+		switch {
+		case f.reachable():
+			status = "VULNERABLE"
+			n++
+		case f.unknown:
+			version, status = "(devel)", "not checked, version unknown"
+		}
+		fmt.Fprintf(&report, "\n%s %s: %s@%s %s\n", f.entry.ID,
+			strings.Join(f.entry.Aliases, " "), f.module, version,
+			status)
+		fmt.Fprintf(&report, "\t%s\n", f.entry.Summary)
+		for _, sym := range f.symbols {
+			fmt.Fprintf(&report, "\tlinked: %s\n", sym)
+		}
+	}
+	fmt.Fprintf(&report, "\n%d vulnerabilities, %d other findings\n", n,
+		len(findings)-n)
+	fmt.Print(report.String())
+	fn := tg.output() + ".vulncheck.txt"
+	host.log("{vulncheck}write", fn)
+	return n, ioutil.WriteFile(fn, []byte(report.String()), 0644)
+}
+
+// matchVulns returns the entries affecting the given module versions,
+// with the vulnerable symbols present in symbols. A module replaced by a
+// directory has an empty version and matches any affected range.
+func matchVulns(entries []*osvEntry, modules map[string]string,
+	symbols map[string]bool) (findings []*vulnFinding) {
+	for _, e := range entries {
+		for _, a := range e.Affected {
+			version, found := modules[a.Package.Name]
+			if !found {
+				continue
+			}
+			f := &vulnFinding{entry: e, module: a.Package.Name,
+				version: version, unknown: version == ""}
+			if !f.unknown && !osvAffected(a.Ranges, version) {
+				continue
+			}
+			for _, imp := range a.EcosystemSpecific.Imports {
+				for _, sym := range imp.Symbols {
+					f.named = true
+					if name := linkedSymbol(symbols, imp.Path,
+						sym); name != "" {
+						f.symbols = append(f.symbols, name)
+					}
+				}
+			}
+			findings = append(findings, f)
+			break
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool {
+		return findings[i].entry.ID < findings[j].entry.ID
+	})
+	return
+}
+
+// linkedSymbol returns the name under which the symbol sym of package
+// pkg, e.g. Decoder.Decode, appears in symbols, or the empty string.
+func linkedSymbol(symbols map[string]bool, pkg, sym string) string {
+	names := []string{pkg + "." + sym}
+	if i := strings.IndexByte(sym, '.'); i > 0 {
+		names = append(names, pkg+".(*"+sym[:i]+")"+sym[i:])
+	}
+	for _, name := range names {
+		if symbols[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// osvAffected reports whether version is within one of the SEMVER ranges.
+func osvAffected(ranges []struct {
+	Type   string
+	Events []struct {
+		Introduced string
+		Fixed      string
+	}
+}, version string) bool {
+	for _, r := range ranges {
+		if r.Type != "SEMVER" {
+			continue
+		}
+		affected := false
+		for _, ev := range r.Events {
+			if ev.Introduced != "" && (ev.Introduced == "0" ||
+				compareSemver(version, ev.Introduced) >= 0) {
+				affected = true
+			}
+			if ev.Fixed != "" && compareSemver(version, ev.Fixed) >= 0 {
+				affected = false
+			}
+		}
+		if affected {
+			return true
+		}
+	}
+	return false
+}
+
+// compareSemver compares semantic versions a and b, with or without a
+// leading v, returning -1, 0 or 1. Build metadata is ignored.
+func compareSemver(a, b string) int {
+	split := func(v string) (nums []int, pre string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexByte(v, '+'); i >= 0 {
+			v = v[:i]
+		}
+		if i := strings.IndexByte(v, '-'); i >= 0 {
+			v, pre = v[:i], v[i+1:]
+		}
+		for _, f := range strings.Split(v, ".") {
+			n, _ := strconv.Atoi(f)
+			nums = append(nums, n)
+		}
+		for len(nums) < 3 {
+			nums = append(nums, 0)
+		}
+		return
+	}
+	an, ap := split(a)
+	bn, bp := split(b)
+	for i := 0; i < 3; i++ {
+		if an[i] != bn[i] {
+			if an[i] < bn[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case ap == bp:
+		return 0
+	case ap == "":
+		return 1
+	case bp == "":
+		return -1
+	}
+	af := strings.Split(ap, ".")
+	bf := strings.Split(bp, ".")
+	for i := 0; i < len(af) && i < len(bf); i++ {
+		if af[i] == bf[i] {
+			continue
+		}
+		x, xerr := strconv.Atoi(af[i])
+		y, yerr := strconv.Atoi(bf[i])
+		switch {
+		case xerr == nil && yerr == nil:
+			if x < y {
+				return -1
+			}
+			return 1
+		case xerr == nil:
+			return -1
+		case yerr == nil:
+			return 1
+		case af[i] < bf[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(af) < len(bf):
+		return -1
+	case len(af) > len(bf):
+		return 1
+	}
+	return 0
+}
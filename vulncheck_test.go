@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCompareSemver(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"v1.2.3", "1.2.3", 0},
+		{"1.21", "1.21.0", 0},
+		{"1.20.14", "1.21.0", -1},
+		{"v0.10.0", "v0.9.1", 1},
+		{"1.21.0-rc.1", "1.21.0", -1},
+		{"1.21.0-rc.2", "1.21.0-rc.10", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-beta", "1.0.0-alpha.1", 1},
+		{"v0.0.0-20200101000000-abcdef", "v0.0.0-20210101000000-123456", -1},
+		{"v1.2.3+incompatible", "v1.2.3", 0},
+	} {
+		if got := compareSemver(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareSemver(%q, %q) = %d, want %d", tc.a,
+				tc.b, got, tc.want)
+		}
+	}
+}
+
+const testOSVEntry = `{
+	"id": "GO-2023-0001",
+	"aliases": ["CVE-2023-0001"],
+	"summary": "Denial of service in example",
+	"affected": [{
+		"package": {"name": "example.com/mod", "ecosystem": "Go"},
+		"ranges": [{"type": "SEMVER", "events": [
+			{"introduced": "0"}, {"fixed": "1.2.0"},
+			{"introduced": "1.3.0"}, {"fixed": "1.3.4"}
+		]}],
+		"ecosystem_specific": {"imports": [{
+			"path": "example.com/mod/pkg",
+			"symbols": ["Decoder.Decode", "Parse"]
+		}]}
+	}]
+}`
+
+func TestMatchVulns(t *testing.T) {
+	e := &osvEntry{}
+	if err := json.Unmarshal([]byte(testOSVEntry), e); err != nil {
+		t.Fatal(err)
+	}
+	symbols := map[string]bool{
+		"example.com/mod/pkg.(*Decoder).Decode": true,
+	}
+	for _, tc := range []struct {
+		version   string
+		found     bool
+		reachable bool
+	}{
+		{"v1.1.9", true, true},
+		{"v1.2.0", false, false},
+		{"v1.3.2", true, true},
+		{"v1.3.4", false, false},
+		{"", true, true}, // directory replacement
+	} {
+		f := matchVulns([]*osvEntry{e},
+			map[string]string{"example.com/mod": tc.version}, symbols)
+		if len(f) > 0 != tc.found {
+			t.Errorf("%q: found %d, want %v", tc.version, len(f),
+				tc.found)
+			continue
+		}
+		if tc.found && f[0].reachable() != tc.reachable {
+			t.Errorf("%q: reachable %v, want %v", tc.version,
+				f[0].reachable(), tc.reachable)
+		}
+	}
+	f := matchVulns([]*osvEntry{e},
+		map[string]string{"example.com/mod": "v1.0.0"}, nil)
+	if len(f) != 1 || f[0].reachable() {
+		t.Errorf("unlinked symbols: got %+v", f)
+	}
+}
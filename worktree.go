@@ -0,0 +1,470 @@
+// Copyright © 2015-2020 Platina Systems, Inc. All rights reserved.
+// Use of this source code is governed by the GPL-2 license described in the
+// LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// buildWorktree is a worktree created by configWorktree under
+// -worktrees/MACHINE/REPO, a shared linux worktree under
+// -worktrees/linux/KEY, whose machine is linux and repo is KEY, or the
+// kernel build directory -builddir/MACHINE, whose repo is linux.
+type buildWorktree struct {
+	repo, machine, dir string
+	shared, build      bool
+}
+
+func (w *buildWorktree) String() string {
+	return w.machine + "/" + w.repo
+}
+
+// gitRepo returns the repository the worktree was added from.
+func (w *buildWorktree) gitRepo() string {
+	if w.shared {
+		return "linux"
+	}
+	return w.repo
+}
+
+// valid reports whether the worktree is still linked to its repository.
+// A kernel build directory is always valid.
+func (w *buildWorktree) valid() bool {
+	if w.build {
+		return true
+	}
+	if _, err := os.Stat(filepath.Join(w.dir, ".git")); err != nil {
+		return false
+	}
+	_, err := shellCommandOutput("cd " + w.dir +
+		" && git rev-parse --git-common-dir 2>/dev/null")
+	return err == nil
+}
+
+// target returns the target the worktree is configured for, or nil.
+// Kernels are no longer built in per machine worktrees, only in their
+// build directories.
+func (w *buildWorktree) target() *target {
+	if w.build {
+		return targetMap[w.machine+".vmlinuz"]
+	}
+	if w.shared || w.repo == "linux" {
+		return nil
+	}
+	return targetMap[w.repo+"-"+w.machine]
+}
+
+// configStamp returns the stamp configure keeps for the worktree's
+// .config, or nil if the worktree belongs to no target.
+func (w *buildWorktree) configStamp() (*configStamp, error) {
+	tg := w.target()
+	if tg == nil || tg.config == "" {
+		return nil, nil
+	}
+	if w.build {
+		return tg.env.kernelConfigStamp(tg)
+	}
+	stamp, err := worktreeStampFile(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	return newConfigStamp(filepath.Join(w.dir, "configs", tg.config),
+		tg.env.bootConfigCommand(tg), stamp)
+}
+
+// configState describes the worktree's .config: missing, stale if its
+// defconfig or config command changed since configure stamped it, as a
+// build would regenerate it, or ? if that can't be told.
+func (w *buildWorktree) configState() string {
+	if _, err := os.Stat(filepath.Join(w.dir, ".config")); err != nil {
+		return "missing"
+	}
+	st, err := w.configStamp()
+	if err != nil || st == nil {
+		return "?"
+	}
+	if !st.current() {
+		return "stale"
+	}
+	return "fresh"
+}
+
+// configStamp is the hash of the defconfig and config command a .config
+// was made with.
+type configStamp struct {
+	fn   string
+	hash string
+}
+
+func newConfigStamp(defconfig, command, fn string) (*configStamp, error) {
+	if *nFlag {
+		return &configStamp{}, nil
+	}
+	b, err := ioutil.ReadFile(defconfig)
+	if err != nil {
+		return nil, err
+	}
+	return configStampOf(b, command, fn), nil
+}
+
+// configStampOf returns the stamp, kept in fn, of a .config made by
+// command from a defconfig with the contents b.
+func configStampOf(b []byte, command, fn string) *configStamp {
+	return &configStamp{
+		fn: fn,
+		hash: fmt.Sprintf("%x", sha256.Sum256(append(append(b, 0),
+			command...))),
+	}
+}
+
+// current reports whether .config was made from the same defconfig and
+// command. A .config made before stamps were kept is assumed to be, and
+// stamped.
+func (s *configStamp) current() bool {
+	if s.fn == "" {
+		return true
+	}
+	b, err := ioutil.ReadFile(s.fn)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return err == nil && strings.TrimSpace(string(b)) == s.hash
+}
+
+func (s *configStamp) write() error {
+	if s.fn == "" {
+		return nil
+	}
+	return ioutil.WriteFile(s.fn, []byte(s.hash+"\n"), 0644)
+}
+
+// configure runs the config command in dir, making confdir/.config from
+// the defconfig file in dir, if reconfig is set, .config is missing or the
+// defconfig or command changed since recorded in the stamp file.
+func configure(name, dir, confdir, defconfig, command, stamp string, reconfig bool) error {
+	fn := defconfig
+	if !filepath.IsAbs(fn) {
+		fn = filepath.Join(dir, defconfig)
+	}
+	st, err := newConfigStamp(fn, command, stamp)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(filepath.Join(confdir, ".config"))
+	if os.IsNotExist(err) {
+		reconfig = true
+	} else if !reconfig && !st.current() {
+		fmt.Printf("# %s: %s or config command changed, "+
+			"regenerating .config\n", name, defconfig)
+		reconfig = true
+	}
+	if reconfig {
+		if err = shellCommandRun("cd " + dir +
+			" && " + command); err != nil {
+			return fmt.Errorf("%s: %s: %s", name, command, err)
+		}
+	}
+	return st.write()
+}
+
+// diskUsage returns the total size of the files in the worktree.
+func (w *buildWorktree) diskUsage() (size int64) {
+	filepath.Walk(w.dir, func(path string, info os.FileInfo,
+		err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// findBuildWorktrees returns the worktrees under -worktrees and the kernel
+// build directories under -builddir matching the MACHINE or MACHINE/REPO
+// patterns, or all of them.
+func findBuildWorktrees(patterns []string) ([]*buildWorktree, error) {
+	wts := []*buildWorktree{}
+	add := func(w *buildWorktree) {
+		if len(patterns) == 0 {
+			wts = append(wts, w)
+			return
+		}
+		for _, p := range patterns {
+			if p == w.machine || p == w.String() {
+				wts = append(wts, w)
+				return
+			}
+		}
+	}
+	machines, err := ioutil.ReadDir(*worktreePath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, m := range machines {
+		if !m.IsDir() {
+			continue
+		}
+		repos, err := ioutil.ReadDir(filepath.Join(*worktreePath,
+			m.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range repos {
+			if !r.IsDir() {
+				continue
+			}
+			add(&buildWorktree{
+				repo:    r.Name(),
+				machine: m.Name(),
+				dir: filepath.Join(*worktreePath, m.Name(),
+					r.Name()),
+				shared: m.Name() == sharedLinux,
+			})
+		}
+	}
+	builds, err := ioutil.ReadDir(*buildDirFlag)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, m := range builds {
+		dir := filepath.Join(*buildDirFlag, m.Name())
+		if !m.IsDir() || !isKernelBuildDir(dir) {
+			continue
+		}
+		add(&buildWorktree{
+			repo:    "linux",
+			machine: m.Name(),
+			dir:     dir,
+			build:   true,
+		})
+	}
+	sort.Slice(wts, func(i, j int) bool {
+		if wts[i].String() == wts[j].String() {
+			return !wts[i].build
+		}
+		return wts[i].String() < wts[j].String()
+	})
+	return wts, nil
+}
+
+// isKernelBuildDir reports whether dir has been configured as a kernel
+// build directory, as opposed to any other directory in -builddir.
+func isKernelBuildDir(dir string) bool {
+	for _, fn := range []string{".config", kernelStampFile} {
+		if _, err := os.Stat(filepath.Join(dir, fn)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// worktreeCommand lists, shows the status of, resets or removes the build
+// worktrees, or prunes those no target uses.
+func worktreeCommand(args []string) error {
+	fs := flag.NewFlagSet("worktree", flag.ContinueOnError)
+	force := fs.Bool("f", false, "reset or remove dirty worktrees")
+	if len(args) == 0 {
+		return fmt.Errorf("missing list, status, reset, " +
+			"prune or rm")
+	}
+	op := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	wts, err := findBuildWorktrees(fs.Args())
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "list":
+		for _, w := range wts {
+			head := "(broken)"
+			if w.build {
+				head = "(build)"
+			} else if w.valid() {
+				head, _ = shellCommandOutput("cd " + w.dir +
+					" && git describe --tags --always")
+			}
+			fmt.Printf("%s\t%s\n", w, head)
+		}
+		return nil
+	case "status":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "MACHINE\tREPO\tHEAD\tTREE\tCONFIG\tSIZE")
+		for _, w := range wts {
+			head, tree, config := "-", "broken", "-"
+			if w.build {
+				tree, config = "build", w.configState()
+			} else if w.valid() {
+				head, _ = shellCommandOutput("cd " + w.dir +
+					" && git rev-parse --short HEAD")
+				tree = "clean"
+				if dirty, err := gitDirty(w.dir); err != nil {
+					tree = "?"
+				} else if dirty {
+					tree = "dirty"
+				}
+				if !w.shared {
+					config = w.configState()
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%dM\n", w.machine,
+				w.repo, head, tree, config,
+				(w.diskUsage()+1<<20-1)>>20)
+		}
+		return tw.Flush()
+	case "reset":
+		if len(fs.Args()) == 0 {
+			return fmt.Errorf("no MACHINE[/REPO] given")
+		}
+		for _, w := range wts {
+			if err := w.reset(*force); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "rm":
+		if len(fs.Args()) == 0 {
+			return fmt.Errorf("no MACHINE[/REPO] given")
+		}
+		for _, w := range wts {
+			if err := w.remove(*force); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "prune":
+		return pruneWorktrees(wts, *force)
+	}
+	return fmt.Errorf("unknown operation %q", op)
+}
+
+// reset discards local changes to the worktree's tracked and untracked
+// files and removes its .config so the next build reconfigures it. Build
+// products ignored by git are kept.
+func (w *buildWorktree) reset(force bool) error {
+	if w.build {
+		return w.resetBuild()
+	}
+	if !w.valid() {
+		return fmt.Errorf("%s: not a git worktree; use rm", w)
+	}
+	if dirty, err := gitDirty(w.dir); err != nil {
+		return err
+	} else if dirty && !force {
+		return fmt.Errorf("%s has local changes; use -f to discard them",
+			w)
+	}
+	lock, err := lockDir(w.dir, "worktree")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	fmt.Printf("# reset %s\n", w)
+	return shellCommandRun("cd " + w.dir +
+		" && git reset -q --hard" +
+		" && git clean -q -fd" +
+		" && rm -f .config")
+}
+
+// resetBuild removes the .config of a kernel build directory so that the
+// next build reconfigures it from its defconfig and fragments.
+func (w *buildWorktree) resetBuild() error {
+	lock, err := lockDir(w.dir, "kernel-"+w.machine)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	fmt.Printf("# reset %s build\n", w)
+	return shellCommandRun("cd " + w.dir + " && rm -f .config")
+}
+
+// remove deletes the worktree with git worktree remove, or if it is no
+// longer linked to its repository or a kernel build directory, just its
+// directory.
+func (w *buildWorktree) remove(force bool) error {
+	if w.build {
+		lock, err := lockDir(w.dir, "kernel-"+w.machine)
+		if err != nil {
+			return err
+		}
+		defer lock.unlock()
+		fmt.Printf("# rm %s build\n", w)
+		return os.RemoveAll(w.dir)
+	}
+	if !w.valid() {
+		fmt.Printf("# rm %s\n", w)
+		return os.RemoveAll(w.dir)
+	}
+	if dirty, err := gitDirty(w.dir); err != nil {
+		return err
+	} else if dirty && !force {
+		return fmt.Errorf("%s has local changes; use -f to remove it",
+			w)
+	}
+	lock, err := lockDir(w.dir, "worktree")
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	fmt.Printf("# rm %s\n", w)
+	dir, err := filepath.Abs(w.dir)
+	if err != nil {
+		return err
+	}
+	gitdir, err := shellCommandOutput("cd " + dir +
+		" && cd `git rev-parse --git-common-dir` && pwd")
+	if err != nil {
+		return err
+	}
+	return shellCommandRun("cd " + gitdir +
+		" && git worktree remove --force " + dir +
+		" && git worktree prune")
+}
+
+// pruneWorktrees removes the worktrees that are broken or belong to no
+// target, and the build directories of machines without a kernel target,
+// then prunes stale worktree records of the source repositories.
+func pruneWorktrees(wts []*buildWorktree, force bool) error {
+	repos := map[string]bool{}
+	for _, w := range wts {
+		if !w.build {
+			repos[w.gitRepo()] = true
+		}
+		if w.valid() && (w.target() != nil || w.shared && w.inUse()) {
+			continue
+		}
+		if err := w.remove(force); err != nil {
+			return err
+		}
+	}
+	for repo := range repos {
+		gitdir, err := findGitdir(repo)
+		if err != nil {
+			continue
+		}
+		if err = shellCommandRun("cd " + gitdir +
+			" && git worktree prune -v"); err != nil {
+			return err
+		}
+	}
+	machines, err := ioutil.ReadDir(*worktreePath)
+	if err != nil {
+		return nil
+	}
+	for _, m := range machines {
+		// Only removes machine directories left empty.
+		os.Remove(filepath.Join(*worktreePath, m.Name()))
+	}
+	return nil
+}